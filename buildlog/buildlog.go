@@ -0,0 +1,186 @@
+package buildlog
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"m0rg.dev/x10/conf"
+)
+
+// Logs live at <log dir>/<package name>/<timestamp>-<stage>.log. The
+// timestamp is fixed-width so names sort chronologically and the stage can be
+// split back out.
+const timestampFormat = "20060102-150405.000000"
+
+func init() {
+	conf.RegisterKey("", "log-dir", conf.ConfigKey{
+		HelpText:   "Where to keep stage logs (defaults to <repo>/logs).",
+		TakesValue: true,
+		Default:    "",
+	})
+
+	conf.RegisterKey("", "log-keep", conf.ConfigKey{
+		HelpText:   "Number of logs to keep per package and stage (0 for no limit).",
+		TakesValue: true,
+		Default:    "10",
+	})
+
+	conf.RegisterKey("", "log-max-age", conf.ConfigKey{
+		HelpText:   "Remove stage logs older than this (e.g. 720h). Empty to keep them.",
+		TakesValue: true,
+		Default:    "",
+	})
+}
+
+func Dir() string {
+	if conf.Get("log-dir") != "" {
+		return conf.Get("log-dir")
+	}
+	return filepath.Join(conf.Get("repo"), "logs")
+}
+
+// Log is an open stage log. Writes are serialized, so the same Log can be
+// handed to several goroutines.
+type Log struct {
+	Path string
+
+	lock sync.Mutex
+	file *os.File
+}
+
+// Create starts a new log for a run of stage in package name, and prunes old
+// ones according to the retention settings.
+func Create(name string, fqn string, stage string) (*Log, error) {
+	dir := filepath.Join(Dir(), name)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	path := filepath.Join(dir, now.Format(timestampFormat)+"-"+stage+".log")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &Log{Path: path, file: file}
+	fmt.Fprintf(file, "# %s: stage %s, started %s\n", fqn, stage, now.Format(time.RFC3339))
+
+	err = prune(dir, stage)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func (log *Log) Write(p []byte) (int, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.file.Write(p)
+}
+
+func (log *Log) Close() error {
+	return log.file.Close()
+}
+
+type entry struct {
+	name  string
+	stage string
+}
+
+func list(dir string) ([]entry, error) {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := []entry{}
+	for _, ent := range ents {
+		name := ent.Name()
+		if ent.IsDir() || !strings.HasSuffix(name, ".log") || len(name) < len(timestampFormat)+len("-.log") {
+			continue
+		}
+		stage := strings.TrimSuffix(name[len(timestampFormat)+1:], ".log")
+		rc = append(rc, entry{name, stage})
+	}
+
+	sort.Slice(rc, func(i, j int) bool { return rc[i].name < rc[j].name })
+	return rc, nil
+}
+
+func prune(dir string, stage string) error {
+	keep := conf.GetInt("log-keep")
+
+	var max_age time.Duration
+	if conf.Get("log-max-age") != "" {
+		var err error
+		max_age, err = time.ParseDuration(conf.Get("log-max-age"))
+		if err != nil {
+			return fmt.Errorf("bad log-max-age: %w", err)
+		}
+	}
+
+	ents, err := list(dir)
+	if err != nil {
+		return err
+	}
+
+	same_stage := []entry{}
+	for _, ent := range ents {
+		if ent.stage == stage {
+			same_stage = append(same_stage, ent)
+		}
+	}
+
+	for idx, ent := range same_stage {
+		remove := keep > 0 && idx < len(same_stage)-keep
+
+		if !remove && max_age > 0 {
+			stamp, err := time.ParseInLocation(timestampFormat, ent.name[:len(timestampFormat)], time.Local)
+			remove = err == nil && time.Since(stamp) > max_age
+		}
+
+		if remove {
+			err := os.Remove(filepath.Join(dir, ent.name))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Latest finds the newest log for package name, optionally limited to one
+// stage.
+func Latest(name string, stage string) (string, error) {
+	dir := filepath.Join(Dir(), name)
+	ents, err := list(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("no logs for %s", name)
+		}
+		return "", err
+	}
+
+	for idx := len(ents) - 1; idx >= 0; idx-- {
+		if stage == "" || ents[idx].stage == stage {
+			return filepath.Join(dir, ents[idx].name), nil
+		}
+	}
+
+	if stage != "" {
+		return "", fmt.Errorf("no %s logs for %s", stage, name)
+	}
+	return "", errors.New("no logs for " + name)
+}
@@ -1,8 +1,14 @@
 package commands
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
 	"m0rg.dev/x10/conf"
 	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/pkgset"
 	"m0rg.dev/x10/plumbing"
 	"m0rg.dev/x10/x10_log"
 	"m0rg.dev/x10/x10_util"
@@ -12,7 +18,7 @@ type BuildCommand struct{}
 
 func init() {
 	RegisterCommand(BuildCommand{}, "build",
-		"[build options] --target-root=<target root> <package name>")
+		"[build options] --target-root=<target root> <package name | @set name>...")
 
 	conf.RegisterKey("build", "target-root", conf.ConfigKey{
 		HelpText:   "Directory to chroot (or equivalent) to during build.",
@@ -31,12 +37,74 @@ func init() {
 		Default:    "false",
 		TakesValue: false,
 	})
+
+	conf.RegisterKey("build", "all", conf.ConfigKey{
+		HelpText:   "Build every package in the packages directory.",
+		Default:    "false",
+		TakesValue: false,
+	})
+
+	conf.RegisterKey("build", "set-root", conf.ConfigKey{
+		HelpText:   "Root to read @set arguments from (defaults to the target root).",
+		Default:    "",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("build", "stage", conf.ConfigKey{
+		HelpText:   "Run only the named stage of the requested packages.",
+		Default:    "",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("build", "from-stage", conf.ConfigKey{
+		HelpText:   "Start the requested packages at the named stage.",
+		Default:    "",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("build", "until-stage", conf.ConfigKey{
+		HelpText:   "Stop the requested packages after the named stage.",
+		Default:    "",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("build", "resume", conf.ConfigKey{
+		HelpText:   "Start over instead of resuming at the stage that failed last time.",
+		Default:    "true",
+		TakesValue: false,
+	})
+
+	conf.RegisterKey("build", "shell-on-failure", conf.ConfigKey{
+		HelpText:   "Start an interactive shell in the build environment when a stage fails.",
+		Default:    "false",
+		TakesValue: false,
+	})
+
+	conf.RegisterKey("build", "jobs", conf.ConfigKey{
+		HelpText:   "Number of packages to build in parallel (each in <target root>.<n>).",
+		Default:    "1",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("build", "snapshots", conf.ConfigKey{
+		HelpText:   "Build in throwaway roots on cached base snapshots: off, overlay, copy or auto.",
+		Default:    "off",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("build", "keep-going", conf.ConfigKey{
+		HelpText:   "Keep building unrelated packages after a failure.",
+		Default:    "false",
+		TakesValue: false,
+	})
 }
 
 func (cmd BuildCommand) Run(args []string) error {
 	logger := x10_log.Get("main")
 
-	conf.AssertArgumentCount("build", 1, args)
+	if len(args) == 0 && !conf.GetBool("build:all") {
+		conf.ParseError("build subcommand expects at least one package, or --all")
+	}
 	conf.AssertConfigured("build", "build:target-root")
 	conf.AssertConfigured("build", "repo")
 
@@ -46,20 +114,80 @@ func (cmd BuildCommand) Run(args []string) error {
 		logger.Fatal(err)
 	}
 
-	contents, err := pkgdb.Read()
+	targets, err := buildTargets(args)
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	fqn, err := contents.FindFQN(args[0])
-	if err != nil {
-		return err
+	stages := plumbing.StageSelection{
+		From:   conf.Get("build:from-stage"),
+		Until:  conf.Get("build:until-stage"),
+		Resume: conf.GetBool("build:resume"),
+	}
+	if conf.Get("build:stage") != "" {
+		if stages.IsPartial() {
+			conf.ParseError("--stage can't be combined with --from-stage or --until-stage")
+		}
+		stages.From = conf.Get("build:stage")
+		stages.Until = conf.Get("build:stage")
 	}
 
-	if contents.Packages[*fqn].GeneratedValid && !conf.GetBool("build:force") {
-		logger.Info("(already built)")
-		return nil
+	results, err := plumbing.Schedule(pkgdb, conf.Get("build:target-root"), targets, plumbing.ScheduleOptions{
+		Jobs:      conf.GetInt("build:jobs"),
+		KeepGoing: conf.GetBool("build:keep-going"),
+		Force:     conf.GetBool("build:force"),
+		Stages:    stages,
+	})
+	if results != nil {
+		printBuildSummary(results)
+	}
+	return err
+}
+
+// buildTargets expands the build command's arguments into a list of atoms.
+// Arguments starting with @ name a package set in the set root.
+func buildTargets(args []string) ([]string, error) {
+	targets := []string{}
+
+	if conf.GetBool("build:all") {
+		all, err := plumbing.AllPackages()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, all...)
+	}
+
+	set_root := conf.Get("build:set-root")
+	if set_root == "" {
+		set_root = conf.Get("build:target-root")
+	}
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			set, err := pkgset.Set(strings.TrimPrefix(arg, "@"), set_root)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, set.List()...)
+		} else {
+			targets = append(targets, arg)
+		}
+	}
+
+	return targets, nil
+}
+
+func printBuildSummary(results []plumbing.BuildResult) {
+	counts := map[plumbing.BuildState]int{}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tRESULT\tREASON")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, result.State, result.Reason)
+		counts[result.State]++
 	}
+	w.Flush()
 
-	return plumbing.Build(args[0])
+	fmt.Printf("\n%d built, %d skipped, %d failed\n",
+		counts[plumbing.StateBuilt], counts[plumbing.StateSkipped], counts[plumbing.StateFailed])
 }
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/lib"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_util"
+)
+
+type EnterCommand struct{}
+
+func init() {
+	RegisterCommand(EnterCommand{}, "enter",
+		"[enter options] <target root> [package name]")
+
+	conf.RegisterKey("enter", "network", conf.ConfigKey{
+		HelpText:   "Give the shell network access.",
+		Default:    "false",
+		TakesValue: false,
+	})
+}
+
+func (cmd EnterCommand) Run(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		conf.ParseError("enter subcommand expects 1 or 2 arguments.")
+	}
+
+	var pkg *spec.SpecLayer
+	if len(args) == 2 {
+		var err error
+		pkg, err = spec.LoadPackage(x10_util.PkgSrc(args[1]))
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.GetBool("enter:network") && !conf.GetBool("runner-network") {
+		conf.ParseError("--network conflicts with --no-runner-network")
+	}
+
+	return lib.EnterShell(pkg, args[0], conf.GetBool("enter:network"))
+}
@@ -0,0 +1,19 @@
+package commands
+
+import (
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/plumbing"
+)
+
+type GenSumCommand struct{}
+
+func init() {
+	RegisterCommand(GenSumCommand{}, "gensum",
+		"<package name>")
+}
+
+func (cmd GenSumCommand) Run(args []string) error {
+	conf.AssertArgumentCount("gensum", 1, args)
+
+	return plumbing.GenSum(args[0])
+}
@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"fmt"
+
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/plumbing"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_util"
+)
+
+type LintCommand struct{}
+
+func init() {
+	RegisterCommand(LintCommand{}, "lint",
+		"[lint options] [package name...]")
+
+	conf.RegisterKey("lint", "target-root", conf.ConfigKey{
+		HelpText:   "Also accept dependencies provided by packages built in this root.",
+		Default:    "",
+		TakesValue: true,
+	})
+
+	conf.RegisterKey("lint", "strict", conf.ConfigKey{
+		HelpText:   "Fail on warnings as well as errors.",
+		Default:    "false",
+		TakesValue: false,
+	})
+}
+
+func (cmd LintCommand) Run(args []string) error {
+	all, err := plumbing.AllPackages()
+	if err != nil {
+		return err
+	}
+
+	names := args
+	if len(names) == 0 {
+		names = all
+	}
+
+	provided, err := lintProviders(all)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, name := range names {
+		for _, problem := range plumbing.Lint(name, provided) {
+			fmt.Println(problem)
+			if problem.Severity == plumbing.LintError || conf.GetBool("lint:strict") {
+				failures++
+			}
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d problem(s) found", failures)
+	}
+	return nil
+}
+
+// lintProviders works out which dependency atoms can be satisfied: any
+// package in the packages directory, by name or FQN, and whatever the
+// database for lint:target-root knows how to provide.
+func lintProviders(all []string) (func(atom string) bool, error) {
+	known := map[string]bool{}
+	for _, name := range all {
+		known[name] = true
+		pkg, err := spec.LoadPackage(x10_util.PkgSrc(name))
+		if err == nil && pkg.Meta != nil {
+			known[pkg.GetFQN()] = true
+			for _, sub := range pkg.Subpackages {
+				subpkg, err := pkg.Subpackage(sub.Name)
+				if err == nil {
+					known[sub.Name] = true
+					known[subpkg.GetFQN()] = true
+				}
+			}
+		}
+	}
+
+	var contents *db.PackageDatabaseContents
+	if conf.Get("lint:target-root") != "" {
+		pkgdb := db.PackageDatabase{BackingFile: x10_util.PkgDb(conf.Get("lint:target-root"))}
+		var err error
+		contents, err = pkgdb.Read()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(atom string) bool {
+		if known[atom] {
+			return true
+		}
+		if contents != nil {
+			_, err := contents.FindFQN(atom)
+			return err == nil
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"io"
+	"os"
+
+	"m0rg.dev/x10/buildlog"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/x10_log"
+)
+
+type LogCommand struct{}
+
+func init() {
+	RegisterCommand(LogCommand{}, "log",
+		"<package name> [stage]")
+}
+
+func (cmd LogCommand) Run(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		conf.ParseError("log subcommand expects 1 or 2 arguments.")
+	}
+
+	stage := ""
+	if len(args) == 2 {
+		stage = args[1]
+	}
+
+	path, err := buildlog.Latest(args[0], stage)
+	if err != nil {
+		return err
+	}
+	x10_log.Get("log").Info(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/plumbing"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_util"
+)
+
+type OutdatedCommand struct{}
+
+func init() {
+	RegisterCommand(OutdatedCommand{}, "outdated",
+		"<target root> [package name...]")
+}
+
+func (cmd OutdatedCommand) Run(args []string) error {
+	if len(args) < 1 {
+		conf.ParseError("outdated subcommand expects at least 1 argument.")
+	}
+
+	pkgdb := db.PackageDatabase{BackingFile: x10_util.PkgDb(args[0])}
+	contents, err := pkgdb.Read()
+	if err != nil {
+		return err
+	}
+
+	names := args[1:]
+	if len(names) == 0 {
+		names, err = plumbing.AllPackages()
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tREASON")
+	for _, name := range names {
+		// A package that can't be checked is reported, rather than
+		// hiding every other one.
+		pkg, err := spec.LoadPackage(x10_util.PkgSrc(name))
+		if err != nil {
+			fmt.Fprintf(w, "%s\tcan't load spec: %s\n", name, err)
+			continue
+		}
+
+		reasons, err := outdatedReasons(contents, *pkg)
+		if err != nil {
+			reasons = []string{"can't compute build hash: " + err.Error()}
+		}
+		if len(reasons) > 0 {
+			fmt.Fprintf(w, "%s\t%s\n", pkg.GetFQN(), strings.Join(reasons, ", "))
+		}
+	}
+	return w.Flush()
+}
+
+// outdatedReasons explains why pkg needs rebuilding, or returns nothing if
+// it doesn't.
+func outdatedReasons(contents *db.PackageDatabaseContents, pkg spec.SpecLayer) ([]string, error) {
+	from_db, ok := contents.Packages[pkg.GetFQN()]
+	if !ok {
+		if fqn, err := contents.FindFQN(pkg.Meta.Name); err == nil {
+			return []string{"not built (have " + *fqn + ")"}, nil
+		}
+		return []string{"not built"}, nil
+	}
+
+	if from_db.BuildHash == "" {
+		if !from_db.GeneratedValid {
+			return []string{"not built"}, nil
+		}
+		return []string{"no build hash recorded"}, nil
+	}
+
+	inputs, err := contents.BuildInputs(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if db.BuildHash(inputs) != from_db.BuildHash {
+		return db.DiffInputs(from_db.BuildInputs, inputs), nil
+	}
+
+	if !from_db.GeneratedValid {
+		return []string{"not built"}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"github.com/sirupsen/logrus"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/lib"
+	"m0rg.dev/x10/plumbing"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_log"
+	"m0rg.dev/x10/x10_util"
+)
+
+type RefreshPatchesCommand struct{}
+
+func init() {
+	RegisterCommand(RefreshPatchesCommand{}, "refresh-patches",
+		"[refresh-patches options] <target root> <package name>")
+
+	conf.RegisterKey("refresh-patches", "patch", conf.ConfigKey{
+		HelpText:   "Patch to regenerate (default: the last one).",
+		Default:    "",
+		TakesValue: true,
+	})
+}
+
+func (cmd RefreshPatchesCommand) Run(args []string) error {
+	conf.AssertArgumentCount("refresh-patches", 2, args)
+	logger := x10_log.Get("refresh-patches").WithField("pkg", args[1])
+
+	pkg, err := spec.LoadPackage(x10_util.PkgSrc(args[1]))
+	if err != nil {
+		return err
+	}
+
+	root, release, err := plumbing.FindBuildRoot(logger, args[0], *pkg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	logger.Infof("Build root: %s", root)
+
+	log := logger.WriterLevel(logrus.DebugLevel)
+	defer log.Close()
+
+	changed, err := lib.RefreshPatch(logger, *pkg, root, conf.Get("refresh-patches:patch"), log)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		logger.Info("Patch updated.")
+	} else {
+		logger.Info("Patch unchanged.")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_util"
+)
+
+type ShowCommand struct{}
+
+func init() {
+	RegisterCommand(ShowCommand{}, "show",
+		"[show options] <package name>")
+
+	conf.RegisterKey("show", "annotate", conf.ConfigKey{
+		HelpText:   "Note which file each value came from.",
+		Default:    "false",
+		TakesValue: false,
+	})
+}
+
+func (cmd ShowCommand) Run(args []string) error {
+	conf.AssertArgumentCount("show", 1, args)
+
+	pkg, origins, err := spec.LoadPackageOrigins(x10_util.PkgSrc(args[0]))
+	if err != nil {
+		return err
+	}
+
+	doc := &yaml.Node{}
+	err = doc.Encode(pkg)
+	if err != nil {
+		return err
+	}
+
+	if conf.GetBool("show:annotate") {
+		annotatePackage(doc, origins)
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(doc)
+}
+
+// annotatePackage adds a comment to each part of doc (an encoded SpecLayer)
+// naming the file it came from.
+func annotatePackage(doc *yaml.Node, origins *spec.SpecOrigins) {
+	annotateKey(doc, origins.Meta, "meta")
+
+	annotateItems(showValue(doc, "depends", "hostbuild"), origins.Depends.HostBuild)
+	annotateItems(showValue(doc, "depends", "build"), origins.Depends.Build)
+	annotateItems(showValue(doc, "depends", "test"), origins.Depends.Test)
+	annotateItems(showValue(doc, "depends", "run"), origins.Depends.Run)
+
+	annotateItems(showValue(doc, "sources"), origins.Sources)
+
+	for name, stage := range origins.Stages {
+		annotateItems(showValue(doc, "stages", name, "prescript"), stage.PreScript)
+		annotateItems(showValue(doc, "stages", name, "postscript"), stage.PostScript)
+		annotateKey(doc, stage.Script, "stages", name, "script")
+		annotateNamed(showValue(doc, "stages", name, "steps"), stage.Steps)
+		annotateKey(doc, stage.UseWorkdir, "stages", name, "useworkdir")
+		annotateKey(doc, stage.Network, "stages", name, "network")
+		annotateKey(doc, stage.Timeout, "stages", name, "timeout")
+		annotateKey(doc, stage.Memory, "stages", name, "memory")
+		annotateKey(doc, stage.CPUs, "stages", name, "cpus")
+	}
+
+	annotateKey(doc, origins.StageOrder, "stageorder")
+	for name, origin := range origins.Environment {
+		annotateKey(doc, origin, "environment", name)
+	}
+	annotateKey(doc, origins.Workdir, "workdir")
+	annotateItems(showValue(doc, "patches"), origins.Patches)
+	for name, origin := range origins.TriggerData {
+		annotateKey(doc, origin, "triggerdata", name)
+	}
+
+	annotateKey(doc, origins.Runner.Image, "runner", "image")
+	annotateItems(showValue(doc, "runner", "mounts"), origins.Runner.Mounts)
+	annotateItems(showValue(doc, "runner", "passenv"), origins.Runner.PassEnv)
+	if tmpfs := showValue(doc, "runner", "tmpfs"); tmpfs != nil {
+		for _, item := range tmpfs.Content {
+			target := showValue(item, "target")
+			if target != nil {
+				annotateNode(item, origins.Runner.Tmpfs[target.Value])
+			}
+		}
+	}
+
+	annotateNamed(showValue(doc, "subpackages"), origins.Subpackages)
+	annotateNamed(showValue(doc, "options"), origins.Options)
+}
+
+// annotateNamed annotates a list of mappings, matching them to origins by
+// their name key.
+func annotateNamed(seq *yaml.Node, origins map[string]string) {
+	if seq == nil {
+		return
+	}
+	for _, item := range seq.Content {
+		name := showValue(item, "name")
+		if name != nil {
+			annotateNode(item, origins[name.Value])
+		}
+	}
+}
+
+// showValue finds the node at keys, starting from a document or mapping node.
+func showValue(node *yaml.Node, keys ...string) *yaml.Node {
+	_, value := showEntry(node, keys...)
+	return value
+}
+
+func showEntry(node *yaml.Node, keys ...string) (*yaml.Node, *yaml.Node) {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	var key *yaml.Node
+	for _, want := range keys {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil, nil
+		}
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == want {
+				key, node = node.Content[i], node.Content[i+1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	return key, node
+}
+
+func annotateKey(doc *yaml.Node, origin string, keys ...string) {
+	key, _ := showEntry(doc, keys...)
+	if key != nil {
+		annotateNode(key, origin)
+	}
+}
+
+func annotateItems(seq *yaml.Node, origins []string) {
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return
+	}
+	for idx, item := range seq.Content {
+		if idx < len(origins) {
+			annotateNode(item, origins[idx])
+		}
+	}
+}
+
+// annotateNode comments node with origin. Comments on mappings go on their
+// first key, so they end up on the same line as the start of the item.
+func annotateNode(node *yaml.Node, origin string) {
+	if origin == "" {
+		return
+	}
+	if rel, err := filepath.Rel(conf.Get("packages"), origin); err == nil {
+		origin = rel
+	}
+
+	if node.Kind == yaml.MappingNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	node.LineComment = "from " + origin
+}
@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/x10_util"
+)
+
+type StatsCommand struct{}
+
+func init() {
+	RegisterCommand(StatsCommand{}, "stats",
+		"[stats options] <target root> [package name]")
+
+	conf.RegisterKey("stats", "top", conf.ConfigKey{
+		HelpText:   "Number of packages to list as the slowest.",
+		Default:    "20",
+		TakesValue: true,
+	})
+}
+
+func (cmd StatsCommand) Run(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		conf.ParseError("stats subcommand expects 1 or 2 arguments.")
+	}
+
+	pkgdb := db.PackageDatabase{BackingFile: x10_util.PkgDb(args[0])}
+	statsdb := pkgdb.Stats()
+	contents, err := statsdb.Read()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 2 {
+		return printPackageStats(contents, args[1])
+	}
+
+	printSlowest(contents, conf.GetInt("stats:top"))
+	if len(contents.Runs) > 0 {
+		fmt.Println()
+		printCriticalPath(contents.Runs[len(contents.Runs)-1])
+	}
+	return nil
+}
+
+type fqnBuild struct {
+	fqn string
+	db.PackageStats
+}
+
+// printSlowest lists the most recent build of each package, slowest first.
+func printSlowest(contents *db.StatsContents, top int) {
+	latest := map[string]fqnBuild{}
+	for fqn, builds := range contents.Packages {
+		if len(builds) == 0 {
+			continue
+		}
+		build := builds[len(builds)-1]
+		if prev, ok := latest[build.Name]; !ok || build.Finished.After(prev.Finished) {
+			latest[build.Name] = fqnBuild{fqn, build}
+		}
+	}
+
+	sorted := []fqnBuild{}
+	for _, build := range latest {
+		sorted = append(sorted, build)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Wall > sorted[j].Wall })
+	if top > 0 && len(sorted) > top {
+		sorted = sorted[:top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tWALL\tCPU\tBINPKG\tINSTALLED")
+	for _, build := range sorted {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", build.fqn, formatDuration(build.Wall), formatDuration(build.CPU),
+			formatSize(build.BinpkgSize), formatSize(build.InstalledSize))
+	}
+	w.Flush()
+}
+
+// printPackageStats shows every recorded build of a package across
+// versions, and where the time went in the latest one.
+func printPackageStats(contents *db.StatsContents, name string) error {
+	builds := []fqnBuild{}
+	for fqn, fqn_builds := range contents.Packages {
+		for _, build := range fqn_builds {
+			if build.Name == name {
+				builds = append(builds, fqnBuild{fqn, build})
+			}
+		}
+	}
+	if len(builds) == 0 {
+		return fmt.Errorf("no statistics for %s", name)
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Finished.Before(builds[j].Finished) })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tFINISHED\tWALL\tCPU\tBINPKG\tINSTALLED")
+	for _, build := range builds {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", build.fqn, build.Finished.Format("2006-01-02 15:04"),
+			formatDuration(build.Wall), formatDuration(build.CPU),
+			formatSize(build.BinpkgSize), formatSize(build.InstalledSize))
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tWALL\tCPU")
+	for _, stage := range builds[len(builds)-1].Stages {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", stage.Stage, formatDuration(stage.Wall), formatDuration(stage.CPU))
+	}
+	w.Flush()
+
+	return nil
+}
+
+// printCriticalPath shows the chain of dependent builds in run that took the
+// longest, i.e. the lower bound on the run's wall time however many jobs it
+// was given.
+func printCriticalPath(run db.RunStats) {
+	packages := map[string]db.RunPackage{}
+	for _, pkg := range run.Packages {
+		packages[pkg.Name] = pkg
+	}
+
+	// Longest path ending at each package, memoized. Requires only point at
+	// packages that finished before this one started, so there are no cycles.
+	longest := map[string]time.Duration{}
+	previous := map[string]string{}
+	var walk func(name string) time.Duration
+	walk = func(name string) time.Duration {
+		if total, ok := longest[name]; ok {
+			return total
+		}
+		pkg := packages[name]
+		best := time.Duration(0)
+		for _, dep := range pkg.Requires {
+			if _, ok := packages[dep]; !ok {
+				continue
+			}
+			if total := walk(dep); total > best {
+				best = total
+				previous[name] = dep
+			}
+		}
+		longest[name] = best + pkg.Finished.Sub(pkg.Started)
+		return longest[name]
+	}
+
+	end := ""
+	for _, pkg := range run.Packages {
+		if total := walk(pkg.Name); end == "" || total > longest[end] {
+			end = pkg.Name
+		}
+	}
+
+	path := []string{}
+	for name := end; name != ""; name = previous[name] {
+		path = append(path, name)
+	}
+
+	fmt.Printf("Last run: %s (%s), building %s\n", run.Started.Format("2006-01-02 15:04"),
+		formatDuration(run.Finished.Sub(run.Started)), strings.Join(run.Targets, " "))
+	fmt.Printf("Critical path: %s\n\n", formatDuration(longest[end]))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tWALL\tRESULT")
+	for idx := len(path) - 1; idx >= 0; idx-- {
+		pkg := packages[path[idx]]
+		result := "built"
+		if pkg.Failed {
+			result = "failed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", pkg.Name, formatDuration(pkg.Finished.Sub(pkg.Started)), result)
+	}
+	w.Flush()
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
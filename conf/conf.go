@@ -55,6 +55,18 @@ func GetBool(key string) bool {
 	return str == "true"
 }
 
+func GetInt(key string) int {
+	str, ok := config[key]
+	if !ok {
+		panic(fmt.Errorf("unknown configuration key: %s", key))
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		ParseError("Option " + key + " expects an integer, got " + str)
+	}
+	return val
+}
+
 // func Set(key string, val string) {
 // 	config[key] = val
 // }
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -118,6 +119,13 @@ func (db *PackageDatabase) Update(pkg spec.SpecLayer, root string, force_invalid
 		return err
 	}
 
+	inputs, err := contents.BuildInputs(pkg)
+	if err != nil {
+		return fmt.Errorf("computing build hash: %w", err)
+	}
+	dbpkg.BuildInputs = inputs
+	dbpkg.BuildHash = BuildHash(inputs)
+
 	contents.Packages[pkg.GetFQN()] = dbpkg
 	if dbpkg.GeneratedValid {
 		for _, prov := range dbpkg.GeneratedProvides {
@@ -188,13 +196,17 @@ func (contents *PackageDatabaseContents) FindFQN(atom string) (*string, error) {
 }
 
 func (db *PackageDatabase) Resolve(logger *logrus.Entry, outstanding map[string]bool) (pkgs []spec.SpecDbData, complete bool, err error) {
-	complete = true
-
 	contents, err := db.Read()
 	if err != nil {
 		return nil, false, err
 	}
 
+	return contents.Resolve(logger, outstanding)
+}
+
+func (contents *PackageDatabaseContents) Resolve(logger *logrus.Entry, outstanding map[string]bool) (pkgs []spec.SpecDbData, complete bool, err error) {
+	complete = true
+
 	resolved := map[string]bool{}
 	resolved_order := []string{}
 
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/spec"
+)
+
+// BuildInputs lists everything a build of pkg depends on, as name => hash
+// (or FQN, for dependencies). Names look like:
+//
+//	spec                   the composited spec, including its environment order
+//	file:<path>            a spec or layer file, relative to the packages dir
+//	patch:<name>           a patch from the files directory
+//	source:<url>           a source's checksum, or a local source's contents
+//	depends:<atom>         the FQN a build dependency resolves to
+//
+// Files that don't exist and dependencies that don't resolve are recorded as
+// missingInput, so they show up as a difference instead of an error.
+func (contents *PackageDatabaseContents) BuildInputs(pkg spec.SpecLayer) (map[string]string, error) {
+	inputs := map[string]string{}
+
+	composite, err := yaml.Marshal(struct {
+		Package     spec.SpecLayer
+		FQN         string
+		Environment []spec.SpecEnvironmentEntry
+	}{pkg, pkg.GetFQN(), pkg.EnvironmentEntries})
+	if err != nil {
+		return nil, err
+	}
+	inputs["spec"] = hashBytes(composite)
+
+	packages := conf.Get("packages")
+	for _, path := range pkg.Files {
+		sum, err := hashInputFile(path)
+		if err != nil {
+			return nil, err
+		}
+		inputs["file:"+relativeTo(packages, path)] = sum
+	}
+
+	if pkg.Patches != nil {
+		for _, patch := range *pkg.Patches {
+			sum, err := hashInputFile(filepath.Join(packages, "files", patch.File))
+			if err != nil {
+				return nil, err
+			}
+			inputs["patch:"+patch.File] = sum
+		}
+	}
+
+	for _, source := range pkg.Sources {
+		sum := source.Checksum
+		parsed, err := url.Parse(source.URL)
+		if err == nil && (parsed.Scheme == "" || parsed.Scheme == "file") {
+			path := parsed.Path
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(packages, "files", path)
+			}
+			sum, err = hashInputFile(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		inputs["source:"+source.URL] = sum
+	}
+
+	atoms := append(append(append([]string{}, pkg.Depends.HostBuild...), pkg.Depends.Build...), pkg.Depends.Test...)
+	for _, atom := range atoms {
+		fqn, err := contents.FindFQN(atom)
+		if err != nil {
+			inputs["depends:"+atom] = missingInput
+		} else {
+			inputs["depends:"+atom] = *fqn
+		}
+	}
+
+	return inputs, nil
+}
+
+const missingInput = "missing"
+
+// BuildHash condenses a set of build inputs into one value.
+func BuildHash(inputs map[string]string) string {
+	lines := []string{}
+	for name, value := range inputs {
+		lines = append(lines, name+"="+value)
+	}
+	sort.Strings(lines)
+	return hashBytes([]byte(strings.Join(lines, "\n")))
+}
+
+// DiffInputs describes how two sets of build inputs differ, one line per
+// input, in order.
+func DiffInputs(old map[string]string, new map[string]string) []string {
+	rc := []string{}
+	for name, value := range new {
+		old_value, ok := old[name]
+		switch {
+		case value == missingInput && old_value != value:
+			rc = append(rc, name+" missing")
+		case !ok:
+			rc = append(rc, name+" added")
+		case old_value != value && strings.HasPrefix(name, "depends:"):
+			rc = append(rc, fmt.Sprintf("%s: %s -> %s", name, old_value, value))
+		case old_value != value:
+			rc = append(rc, name+" changed")
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			rc = append(rc, name+" removed")
+		}
+	}
+	sort.Strings(rc)
+	return rc
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func hashInputFile(path string) (string, error) {
+	sum, err := hashFile(path)
+	if os.IsNotExist(err) {
+		return missingInput, nil
+	}
+	return sum, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+func relativeTo(base string, path string) string {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -29,6 +29,7 @@ func (db *PackageDatabase) IndexFromRepo() error {
 	group := new(errgroup.Group)
 
 	var updates sync.Map
+	var loaded sync.Map
 
 	filepath.WalkDir(conf.Get("packages"), func(path string, d fs.DirEntry, err error) error {
 		if d.Name() == "layers" ||
@@ -50,37 +51,55 @@ func (db *PackageDatabase) IndexFromRepo() error {
 				if err != nil {
 					return err
 				}
-				binpkg_path := filepath.Join(conf.Get("repo"), "binpkgs", from_repo.GetFQN()+".tar.xz")
-				pkgstat, err := os.Stat(binpkg_path)
-				doupdate := false
 
-				if !contents.CheckUpToDate(*from_repo) {
-					local_logger.Infof("Updating database (outdated)")
-					doupdate = true
+				// Subpackages are indexed separately, but come from the same
+				// spec file.
+				pkgs := []*spec.SpecLayer{from_repo}
+				for _, sub := range from_repo.Subpackages {
+					subpkg, err := from_repo.Subpackage(sub.Name)
+					if err != nil {
+						return err
+					}
+					pkgs = append(pkgs, subpkg)
 				}
 
-				if !doupdate && !contents.Packages[from_repo.GetFQN()].GeneratedValid {
-					if err == nil {
-						// TODO: did I forget to put something here?
-					} else {
-						local_logger.Infof("Updating database (not built)")
+				for _, pkg := range pkgs {
+					loaded.Store(pkg.GetFQN(), pkg)
+
+					binpkg_path := filepath.Join(conf.Get("repo"), "binpkgs", pkg.GetFQN()+".tar.xz")
+					pkgstat, err := os.Stat(binpkg_path)
+					doupdate := false
+
+					if !contents.CheckUpToDate(*pkg) {
+						local_logger.Infof("Updating database (outdated)")
 						doupdate = true
 					}
-				}
 
-				if !doupdate && err != nil {
-					local_logger.Infof("Updating database (stat error on binpkg)")
-					doupdate = true
-				}
+					if !doupdate && !contents.Packages[pkg.GetFQN()].GeneratedValid {
+						if err == nil {
+							// TODO: did I forget to put something here?
+						} else {
+							local_logger.Infof("Updating database (not built)")
+							doupdate = true
+						}
+					}
 
-				if srcstat != nil && pkgstat != nil && srcstat.ModTime().Unix() > pkgstat.ModTime().Unix() {
-					local_logger.Infof("Updating database (source is newer)")
-					doupdate = true
-				}
+					if !doupdate && err != nil {
+						local_logger.Infof("Updating database (stat error on binpkg)")
+						doupdate = true
+					}
+
+					// Packages built with a build hash are checked against it
+					// below, once the provider index is up to date.
+					from_db := contents.Packages[pkg.GetFQN()]
+					if from_db.BuildHash == "" && srcstat != nil && pkgstat != nil && srcstat.ModTime().Unix() > pkgstat.ModTime().Unix() {
+						local_logger.Infof("Updating database (source is newer)")
+						doupdate = true
+					}
 
-				if doupdate {
-					repo_to_db := from_repo.ToDB()
-					updates.Store(from_repo.GetFQN(), repo_to_db)
+					if doupdate {
+						updates.Store(pkg.GetFQN(), outdatedEntry(*pkg, from_db))
+					}
 				}
 				return nil
 			})
@@ -151,11 +170,48 @@ func (db *PackageDatabase) IndexFromRepo() error {
 		contents.maybeAddProvider(dbpkg.Meta.Name, fqn)
 	}
 
+	// Build hashes resolve dependencies through the provider index, so
+	// they're checked last.
+	loaded.Range(func(key interface{}, value interface{}) bool {
+		fqn := key.(string)
+		pkg := value.(*spec.SpecLayer)
+		from_db, ok := contents.Packages[fqn]
+		if !ok || !from_db.GeneratedValid || from_db.BuildHash == "" {
+			return true
+		}
+
+		local_logger := logger.WithField("fqn", fqn)
+		inputs, err := contents.BuildInputs(*pkg)
+		if err != nil {
+			local_logger.Infof("Updating database (can't compute build hash: %s)", err)
+		} else if BuildHash(inputs) != from_db.BuildHash {
+			local_logger.Infof("Updating database (build inputs changed: %s)",
+				strings.Join(DiffInputs(from_db.BuildInputs, inputs), ", "))
+		} else {
+			return true
+		}
+
+		contents.Packages[fqn] = outdatedEntry(*pkg, from_db)
+		return true
+	})
+
 	db.unlocked_Write(contents)
 	logger.Info("Updated package database in " + db.BackingFile + ".")
 	return nil
 }
 
+// outdatedEntry is the database entry for a package that needs rebuilding.
+// It keeps the inputs of the last build, so it's possible to tell what
+// changed, and the trigger data of the binpkg that was built from them,
+// since that's what gets installed until it's rebuilt.
+func outdatedEntry(pkg spec.SpecLayer, from_db spec.SpecDbData) spec.SpecDbData {
+	rc := pkg.ToDB()
+	rc.BuildHash = from_db.BuildHash
+	rc.BuildInputs = from_db.BuildInputs
+	rc.TriggerData = from_db.TriggerData
+	return rc
+}
+
 func getFileFromBinpkg(binpkg_path string, file string) (string, error) {
 	cmd := exec.Command("tar", "xf", binpkg_path, file, "-O")
 	out, err := cmd.CombinedOutput()
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"gopkg.in/yaml.v2"
+)
+
+// How much history to keep.
+const (
+	maxBuildsPerPackage = 10
+	maxRuns             = 10
+)
+
+type StageStats struct {
+	Stage string
+	Wall  time.Duration
+	CPU   time.Duration
+}
+
+// PackageStats describes one build of a package.
+type PackageStats struct {
+	Name          string
+	Finished      time.Time
+	Wall          time.Duration
+	CPU           time.Duration
+	Stages        []StageStats
+	BinpkgSize    int64
+	InstalledSize int64
+}
+
+// RunPackage is one package built (or attempted) as part of a run.
+type RunPackage struct {
+	Name     string
+	Started  time.Time
+	Finished time.Time
+	Requires []string
+	Failed   bool
+}
+
+// RunStats describes one invocation of the build scheduler.
+type RunStats struct {
+	Started  time.Time
+	Finished time.Time
+	Targets  []string
+	Packages []RunPackage
+}
+
+type StatsContents struct {
+	Packages map[string][]PackageStats // FQN -> builds, oldest first
+	Runs     []RunStats                // oldest first
+}
+
+// StatsDatabase keeps build statistics alongside a package database.
+type StatsDatabase struct {
+	BackingFile string
+}
+
+func (db *PackageDatabase) Stats() StatsDatabase {
+	return StatsDatabase{filepath.Join(filepath.Dir(db.BackingFile), "stats.yml")}
+}
+
+func (db *StatsDatabase) unlocked_Read() (*StatsContents, error) {
+	contents := &StatsContents{}
+
+	raw_contents, err := ioutil.ReadFile(db.BackingFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = yaml.UnmarshalStrict(raw_contents, contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if contents.Packages == nil {
+		contents.Packages = map[string][]PackageStats{}
+	}
+	return contents, nil
+}
+
+func (db *StatsDatabase) Read() (*StatsContents, error) {
+	lock := flock.New(db.BackingFile + ".lock")
+	lock.RLock()
+	defer lock.Close()
+
+	return db.unlocked_Read()
+}
+
+func (db *StatsDatabase) update(fn func(*StatsContents)) error {
+	lock := flock.New(db.BackingFile + ".lock")
+	lock.Lock()
+	defer lock.Close()
+
+	contents, err := db.unlocked_Read()
+	if err != nil {
+		return err
+	}
+
+	fn(contents)
+
+	d, err := yaml.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(db.BackingFile), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(db.BackingFile, d, os.ModePerm)
+}
+
+func (db *StatsDatabase) RecordBuild(fqn string, stats PackageStats) error {
+	return db.update(func(contents *StatsContents) {
+		builds := append(contents.Packages[fqn], stats)
+		if len(builds) > maxBuildsPerPackage {
+			builds = builds[len(builds)-maxBuildsPerPackage:]
+		}
+		contents.Packages[fqn] = builds
+	})
+}
+
+func (db *StatsDatabase) RecordRun(run RunStats) error {
+	return db.update(func(contents *StatsContents) {
+		contents.Runs = append(contents.Runs, run)
+		if len(contents.Runs) > maxRuns {
+			contents.Runs = contents.Runs[len(contents.Runs)-maxRuns:]
+		}
+	})
+}
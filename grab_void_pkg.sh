@@ -14,7 +14,7 @@ tmp=/tmp/x10/voidpkg.out.$(uuidgen)
 template_modified=/tmp/x10/voidpkg.template.$(uuidgen)
 trap cleanup EXIT
 
-sed -e 's/${version}/\\${X10_META_VERSION}/g' $VOID_PACKAGES/srcpkgs/$1/template >$template_modified
+sed -e 's/${version}/\\${meta.version}/g' $VOID_PACKAGES/srcpkgs/$1/template >$template_modified
 
 source $VOID_PACKAGES/common/environment/fetch/misc.sh
 source $VOID_PACKAGES/common/environment/setup/options.sh
@@ -95,15 +95,31 @@ func Install(pkgdb db.PackageDatabase, pkg spec.SpecDbData, root string) error {
 		return err
 	}
 
-	spec, err := pkg.ToLayer()
+	trigger_data, err := triggerData(pkg)
 	if err != nil {
 		return err
 	}
 
-	err = trigger.RunTriggers(*spec, root)
+	replaced, err := replacedVersion(pkgdb, installed, pkg)
 	if err != nil {
 		return err
 	}
+	if replaced != nil {
+		logger.Infof("Upgrading: %s -> %s", replaced.GetFQN(), pkg.GetFQN())
+		old_data, err := triggerData(*replaced)
+		if err != nil {
+			return err
+		}
+		err = trigger.RunUpgradeTriggers(replaced.GetFQN(), old_data, pkg.GetFQN(), trigger_data, root)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = trigger.RunInstallTriggers(pkg.GetFQN(), trigger_data, root)
+		if err != nil {
+			return err
+		}
+	}
 
 	installed.Mark(pkg.GetFQN())
 	return installed.Write()
@@ -111,6 +127,28 @@ func Install(pkgdb db.PackageDatabase, pkg spec.SpecDbData, root string) error {
 
 func Remove(pkgdb db.PackageDatabase, pkg spec.SpecDbData, root string) error {
 	logger := x10_log.Get("remove").WithField("pkg", pkg.GetFQN())
+	installed, err := pkgset.Set("installed", root)
+	if err != nil {
+		return err
+	}
+
+	// If another version has been installed in this one's place, the
+	// upgrade triggers have already dealt with it.
+	replaced_by, err := replacedVersion(pkgdb, installed, pkg)
+	if err != nil {
+		return err
+	}
+	if replaced_by == nil {
+		trigger_data, err := triggerData(pkg)
+		if err != nil {
+			logger.Warnf("Not running removal triggers: %s", err)
+		} else {
+			err = trigger.RunRemoveTriggers(pkg.GetFQN(), trigger_data, root)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	extract_cmd := exec.Command("tar", "tf", filepath.Join(conf.Get("repo"), "binpkgs", pkg.GetFQN()+".tar.xz"))
 	out, err := extract_cmd.CombinedOutput()
@@ -171,10 +209,6 @@ func Remove(pkgdb db.PackageDatabase, pkg spec.SpecDbData, root string) error {
 		}
 	}
 
-	installed, err := pkgset.Set("installed", root)
-	if err != nil {
-		return err
-	}
 	installed.Unmark(pkg.GetFQN())
 	err = installed.Write()
 	if err != nil {
@@ -184,3 +218,32 @@ func Remove(pkgdb db.PackageDatabase, pkg spec.SpecDbData, root string) error {
 
 	return nil
 }
+
+// triggerData is the trigger data pkg was built with, or what its spec has
+// now if the database doesn't say.
+func triggerData(pkg spec.SpecDbData) (map[string]interface{}, error) {
+	if pkg.TriggerData != nil {
+		return pkg.TriggerData, nil
+	}
+	layer, err := pkg.ToLayer()
+	if err != nil {
+		return nil, err
+	}
+	return layer.TriggerData, nil
+}
+
+// replacedVersion finds the other installed version of pkg, if there is one.
+func replacedVersion(pkgdb db.PackageDatabase, installed *pkgset.PackageSet, pkg spec.SpecDbData) (*spec.SpecDbData, error) {
+	contents, err := pkgdb.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fqn := range installed.List() {
+		other, ok := contents.Packages[fqn]
+		if ok && fqn != pkg.GetFQN() && other.Meta.Name == pkg.Meta.Name {
+			return &other, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,283 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/runner"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_log"
+)
+
+// PatchStage is the stage in which x10 applies a package's patches, before
+// running any scripts the stage has.
+const PatchStage = "patch"
+
+// Patches apply to the work tree ($X10_WORKDIR in the build root), and are
+// run through the runner like everything else, reading the patches from
+// /pkgfiles. The tree as it was before patching is kept alongside it, so
+// the patch stage can start over and refresh-patches has something to diff
+// against, until the build finishes or a stage before patching runs again.
+func workTree(pkg spec.SpecLayer) (string, error) {
+	if pkg.Workdir == "" {
+		return "", fmt.Errorf("%s has patches but no workdir", pkg.GetFQN())
+	}
+	return filepath.Clean(pkg.Workdir), nil
+}
+
+func pristineTree(tree string) string {
+	return tree + ".x10-orig"
+}
+
+// DiscardPristineTree removes the unpatched copy of pkg's work tree in root,
+// once the tree it was taken from is gone or about to be replaced.
+func DiscardPristineTree(pkg spec.SpecLayer, root string) error {
+	if pkg.Workdir == "" {
+		return nil
+	}
+	orig := pristineTree(filepath.Clean(pkg.Workdir))
+	if _, err := os.Stat(filepath.Join(root, orig)); os.IsNotExist(err) {
+		return nil
+	}
+
+	opts, err := runner.NewOptions(&pkg)
+	if err != nil {
+		return err
+	}
+	logger := x10_log.Get("patch").WithField("pkg", pkg.GetFQN())
+	return runner.RunTargetScript(logger, root, "rm -rf "+runner.ShellQuote(orig), opts)
+}
+
+// runsBeforePatching reports whether stage comes before PatchStage in pkg's
+// stage order, i.e. whether it may remake the work tree.
+func runsBeforePatching(pkg spec.SpecLayer, stage string) bool {
+	if pkg.StageOrder == nil {
+		return false
+	}
+	stage_idx, patch_idx := -1, -1
+	for idx, s := range *pkg.StageOrder {
+		switch s {
+		case stage:
+			stage_idx = idx
+		case PatchStage:
+			patch_idx = idx
+		}
+	}
+	return stage_idx >= 0 && stage_idx < patch_idx
+}
+
+func patchFile(patch spec.SpecPatch) string {
+	return filepath.Join(conf.Get("packages"), "files", patch.File)
+}
+
+// Each patch is announced with a line like this before it's run, which is
+// how patchError knows which one went wrong. Other steps announce themselves
+// with other "# " lines.
+var patchAnnounceRegexp = regexp.MustCompile(`^# applying (.+) \(-p\d+\)$`)
+
+func announcePatch(patch spec.SpecPatch) string {
+	announce := fmt.Sprintf("# applying %s (-p%d)", patch.File, patch.StripLevel())
+	return "{ echo " + runner.ShellQuote(announce) + "; } 2>/dev/null"
+}
+
+// patchCommand runs patch into tree, a shell word.
+func patchCommand(tree string, patch spec.SpecPatch, extra_args ...string) string {
+	args := []string{
+		"patch", "--batch", "--fuzz=0", "--no-backup-if-mismatch",
+		"-p" + strconv.Itoa(patch.StripLevel()),
+		"-d", tree,
+		"-i", runner.ShellQuote(filepath.Join("/pkgfiles", patch.File)),
+	}
+	return strings.Join(append(args, extra_args...), " ")
+}
+
+// ApplyPatches applies pkg's patches to its work tree in root, in order.
+// Each one is checked with a dry run first, so a patch that doesn't apply
+// cleanly (including with fuzz) fails without touching anything, and the
+// error says which hunk was rejected.
+func ApplyPatches(logger *logrus.Entry, pkg spec.SpecLayer, root string, opts runner.Options) error {
+	if pkg.Patches == nil || len(*pkg.Patches) == 0 {
+		return nil
+	}
+
+	tree, err := workTree(pkg)
+	if err != nil {
+		return err
+	}
+	orig := pristineTree(tree)
+
+	lines := []string{
+		// Patched before (we're resuming, or running the stage again), so
+		// start from the unpatched tree.
+		"if [ -e " + runner.ShellQuote(orig) + " ]; then",
+		"{ echo " + runner.ShellQuote("# restoring "+tree) + "; } 2>/dev/null",
+		"rm -rf " + runner.ShellQuote(tree),
+		"cp -a --reflink=auto " + runner.ShellQuote(orig) + " " + runner.ShellQuote(tree),
+		"else",
+		"cp -a --reflink=auto " + runner.ShellQuote(tree) + " " + runner.ShellQuote(orig),
+		"fi",
+	}
+	for _, patch := range *pkg.Patches {
+		lines = append(lines,
+			announcePatch(patch),
+			patchCommand(runner.ShellQuote(tree), patch, "--forward", "--dry-run"),
+			patchCommand(runner.ShellQuote(tree), patch, "--forward"),
+		)
+	}
+
+	return runPatchScript(logger, pkg, root, strings.Join(lines, "\n"), opts)
+}
+
+// runPatchScript runs script, turning a failure into an error that says
+// which patch and hunk it came from.
+func runPatchScript(logger *logrus.Entry, pkg spec.SpecLayer, root string, script string, opts runner.Options) error {
+	out := bytes.Buffer{}
+	if opts.Log != nil {
+		opts.Log = io.MultiWriter(opts.Log, &out)
+	} else {
+		opts.Log = &out
+	}
+	// What patching costs isn't worth recording.
+	opts.Usage = nil
+
+	err := runner.RunTargetScript(logger, root, script, opts)
+	if err != nil {
+		return patchError(pkg, &out, err)
+	}
+	return nil
+}
+
+var (
+	patchFileRegexp   = regexp.MustCompile(`^(?:patching|checking) file (.+)$`)
+	patchFailedRegexp = regexp.MustCompile(`^Hunk #(\d+) FAILED at (\d+)`)
+)
+
+// patchError finds the first problem patch reported in out, the output of a
+// script from ApplyPatches or RefreshPatch that failed with err.
+func patchError(pkg spec.SpecLayer, out io.Reader, err error) error {
+	strip := map[string]int{}
+	for _, patch := range *pkg.Patches {
+		strip[patch.File] = patch.StripLevel()
+	}
+
+	patch, file := "", ""
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# ") {
+			patch, file = "", ""
+			if match := patchAnnounceRegexp.FindStringSubmatch(line); match != nil {
+				patch = match[1]
+			}
+			continue
+		}
+		if patch == "" {
+			continue
+		}
+		if match := patchFileRegexp.FindStringSubmatch(line); match != nil {
+			file = match[1]
+		}
+		if match := patchFailedRegexp.FindStringSubmatch(line); match != nil {
+			return fmt.Errorf("%s: hunk #%s of %s failed at line %s", patch, match[1], file, match[2])
+		}
+		if strings.HasPrefix(line, "can't find file to patch") {
+			return fmt.Errorf("%s: can't find file to patch (is -p%d right?)", patch, strip[patch])
+		}
+		if strings.HasPrefix(line, "Reversed (or previously applied) patch detected") {
+			return fmt.Errorf("%s: already applied to %s", patch, file)
+		}
+	}
+	if patch != "" {
+		return fmt.Errorf("%s: %w", patch, err)
+	}
+	return err
+}
+
+// RefreshPatch regenerates the named patch (or the last one, if name is
+// empty) from pkg's modified work tree in root: it's the difference between
+// the unpatched tree with the patches before it applied, and the current tree
+// with the ones after it taken back out. It returns whether the patch
+// changed.
+func RefreshPatch(logger *logrus.Entry, pkg spec.SpecLayer, root string, name string, log io.Writer) (bool, error) {
+	if pkg.Patches == nil || len(*pkg.Patches) == 0 {
+		return false, fmt.Errorf("%s has no patches", pkg.GetFQN())
+	}
+	patches := *pkg.Patches
+
+	index := len(patches) - 1
+	if name != "" {
+		index = -1
+		for idx, patch := range patches {
+			if patch.File == name {
+				index = idx
+			}
+		}
+		if index < 0 {
+			return false, fmt.Errorf("%s has no patch %s", pkg.GetFQN(), name)
+		}
+	}
+	target := patches[index]
+	if target.StripLevel() != 1 {
+		return false, fmt.Errorf("%s: only patches with strip level 1 can be refreshed", target.File)
+	}
+
+	tree, err := workTree(pkg)
+	if err != nil {
+		return false, err
+	}
+	orig := pristineTree(tree)
+	if _, err := os.Stat(filepath.Join(root, orig)); err != nil {
+		return false, fmt.Errorf("no unpatched tree at %s (has the patch stage run?)", filepath.Join(root, orig))
+	}
+
+	lines := []string{
+		"x10_refresh=$(mktemp -d " + runner.ShellQuote(filepath.Join(filepath.Dir(tree), ".x10-refresh.XXXXXX")) + ")",
+		"trap 'rm -rf \"$x10_refresh\"' EXIT",
+		"cp -a --reflink=auto " + runner.ShellQuote(orig) + " \"$x10_refresh/a\"",
+	}
+	for _, patch := range patches[:index] {
+		lines = append(lines, announcePatch(patch), patchCommand(`"$x10_refresh/a"`, patch, "--forward"))
+	}
+	lines = append(lines, "cp -a --reflink=auto "+runner.ShellQuote(tree)+" \"$x10_refresh/b\"")
+	for idx := len(patches) - 1; idx > index; idx-- {
+		lines = append(lines, announcePatch(patches[idx]), patchCommand(`"$x10_refresh/b"`, patches[idx], "--reverse"))
+	}
+
+	dest := runner.ShellQuote(filepath.Join("/pkgfiles", target.File))
+	lines = append(lines,
+		"{ echo '# diffing'; } 2>/dev/null",
+		"cd \"$x10_refresh\"",
+		// 1 just means there were differences.
+		"diff -Naur a b > diff || [ $? -eq 1 ]",
+		// Timestamps would change every time.
+		`sed -E 's/^((---|\+\+\+) [^\t]+)\t.*$/\1/' diff > patch`,
+		"cmp -s patch "+dest+" || cat patch > "+dest,
+	)
+
+	opts, err := runner.NewOptions(&pkg)
+	if err != nil {
+		return false, err
+	}
+	opts.Log = log
+
+	before, _ := ioutil.ReadFile(patchFile(target))
+	err = runPatchScript(logger, pkg, root, strings.Join(lines, "\n"), opts)
+	if err != nil {
+		return false, err
+	}
+	after, err := ioutil.ReadFile(patchFile(target))
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(before, after), nil
+}
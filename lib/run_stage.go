@@ -1,84 +1,219 @@
 package lib
 
 import (
+	"fmt"
+	"io"
 	"io/fs"
 	"io/ioutil"
 	"path/filepath"
+	"runtime"
 	"strings"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"m0rg.dev/x10/buildlog"
+	"m0rg.dev/x10/conf"
 	"m0rg.dev/x10/db"
 	"m0rg.dev/x10/runner"
 	"m0rg.dev/x10/spec"
 	"m0rg.dev/x10/x10_log"
-	"m0rg.dev/x10/x10_util"
 )
 
-func RunStage(pkg spec.SpecLayer, stage string, root string) error {
+func init() {
+	conf.RegisterKey("", "verbose", conf.ConfigKey{
+		HelpText:   "Show stage output as it happens.",
+		TakesValue: false,
+		Default:    "false",
+	})
+}
+
+// verboseWriter passes stage output lines on to a logger, which tags them
+// with the package and stage.
+type verboseWriter struct {
+	logger *logrus.Entry
+}
+
+func (w verboseWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// StageNetwork reports whether stage should run with network access. Stages
+// have to ask for it explicitly, and asking is an error if network access is
+// disabled globally.
+func StageNetwork(pkg spec.SpecLayer, stage string) (bool, error) {
+	if pkg.Stages[stage] == nil || pkg.Stages[stage].Network == nil || !*pkg.Stages[stage].Network {
+		return false, nil
+	}
+	if !conf.GetBool("runner-network") {
+		return false, fmt.Errorf("stage %s needs network access, but network access is disabled", stage)
+	}
+	return true, nil
+}
+
+// RunStage runs one stage of pkg in root, and reports what it cost. The
+// package stage also runs once for each subpackage, after their files have
+// been split off.
+func RunStage(pkgdb db.PackageDatabase, pkg spec.SpecLayer, stage string, root string) (runner.Usage, error) {
+	if runsBeforePatching(pkg, stage) {
+		// The patch stage mustn't restore a tree from before this one.
+		err := DiscardPristineTree(pkg, root)
+		if err != nil {
+			return runner.Usage{}, err
+		}
+	}
+
+	if stage != "package" || len(pkg.Subpackages) == 0 {
+		return runStage(pkgdb, pkg, stage, root)
+	}
+
+	err := SplitSubpackages(pkg, root)
+	if err != nil {
+		return runner.Usage{}, err
+	}
+
+	usage, err := runStage(pkgdb, pkg, stage, root)
+	if err != nil {
+		return usage, err
+	}
+
+	for _, sub := range pkg.Subpackages {
+		subpkg, err := pkg.Subpackage(sub.Name)
+		if err != nil {
+			return usage, err
+		}
+
+		sub_usage, err := runStage(pkgdb, *subpkg, stage, root)
+		usage.Wall += sub_usage.Wall
+		usage.CPU += sub_usage.CPU
+		if err != nil {
+			return usage, err
+		}
+	}
+
+	return usage, nil
+}
+
+func runStage(pkgdb db.PackageDatabase, pkg spec.SpecLayer, stage string, root string) (runner.Usage, error) {
 	logger := x10_log.Get("run").WithField("stage", stage).WithField("package", pkg.GetFQN())
 	logger.Info("Running")
 
-	if pkg.Stages[stage] == nil {
+	usage := runner.Usage{}
+
+	stage_spec := pkg.Stages[stage]
+	if stage_spec == nil && stage == PatchStage && pkg.Patches != nil {
+		// Patches get applied even if the stage has no scripts of its own.
+		stage_spec = &spec.SpecStage{UseWorkdir: new(bool)}
+	}
+	if stage_spec == nil {
 		logger.Info("  <empty stage>")
-		return nil
+		return usage, nil
 	}
 
-	additional_args := []string{}
+	limits, err := runner.StageLimits(stage_spec)
+	if err != nil {
+		return usage, err
+	}
 
 	script_chunks := []string{}
-	script_chunks = append(script_chunks, pkg.GetEnvironmentSetupScript())
+	script_chunks = append(script_chunks, pkg.GetEnvironmentSetupScript(limits.MakeJobs(runtime.NumCPU())))
 
-	if *pkg.Stages[stage].UseWorkdir {
+	if *stage_spec.UseWorkdir {
 		script_chunks = append(script_chunks, "cd \"$X10_WORKDIR\"")
 	}
 
-	script_chunks = append(script_chunks, pkg.Stages[stage].PreScript...)
-	if pkg.Stages[stage].Script != nil {
-		script_chunks = append(script_chunks, *pkg.Stages[stage].Script)
+	script_chunks = append(script_chunks, stage_spec.PreScript...)
+	if stage_spec.Script != nil {
+		script_chunks = append(script_chunks, *stage_spec.Script)
+	}
+	if len(stage_spec.Steps) > 0 {
+		script_chunks = append(script_chunks, stepsScript(stage_spec.Steps))
+	}
+	script_chunks = append(script_chunks, stage_spec.PostScript...)
+
+	opts, err := runner.NewOptions(&pkg)
+	if err != nil {
+		return usage, err
+	}
+
+	opts.Network, err = StageNetwork(pkg, stage)
+	if err != nil {
+		return usage, err
+	}
+	opts.Limits = limits
+	opts.Usage = &usage
+
+	log, err := buildlog.Create(pkg.Meta.Name, pkg.GetFQN(), stage)
+	if err != nil {
+		return usage, err
+	}
+	defer log.Close()
+
+	if conf.GetBool("verbose") {
+		opts.Log = io.MultiWriter(log, verboseWriter{logger})
+	} else {
+		status := x10_log.NewStatus(pkg.Meta.Name + "  " + stage)
+		defer status.Done()
+		opts.Log = io.MultiWriter(log, status)
 	}
-	script_chunks = append(script_chunks, pkg.Stages[stage].PostScript...)
 
-	err := runner.RunTargetScript(logger, root, strings.Join(script_chunks, "\n"), additional_args)
+	if stage == PatchStage {
+		err = ApplyPatches(logger, pkg, root, opts)
+		if err != nil {
+			fmt.Fprintf(log, "# failed: %s\n", err)
+			logger.Errorf("Full log: %s", log.Path)
+			return usage, err
+		}
+	}
+
+	steps := newStepTracker(logger, opts.Log, stage_spec.Steps)
+	opts.Log = steps
+	err = runner.RunTargetScript(logger, root, strings.Join(script_chunks, "\n"), opts)
+	if err != nil {
+		err = steps.wrap(err)
+	}
 
 	if err != nil {
-		return err
+		fmt.Fprintf(log, "# failed: %s\n", err)
+		logger.Errorf("Full log: %s", log.Path)
+		return usage, err
 	}
+	fmt.Fprintln(log, "# finished")
 
 	if stage == "package" {
 		d, err := yaml.Marshal(pkg.Meta)
 		if err != nil {
 			logger.Error("Error while marshalling package metadata: ")
 			logger.Error(err)
-			return err
+			return usage, err
 		}
 		err = ioutil.WriteFile(filepath.Join(root, "destdir", pkg.GetFQN(), "meta.yml"), d, fs.ModePerm)
 		if err != nil {
 			logger.Error("Error while writing package metadata: ")
 			logger.Error(err)
-			return err
+			return usage, err
 		}
 
 		d, err = yaml.Marshal(pkg.Depends)
 		if err != nil {
 			logger.Error("Error while marshalling package dependencies: ")
 			logger.Error(err)
-			return err
+			return usage, err
 		}
 		err = ioutil.WriteFile(filepath.Join(root, "destdir", pkg.GetFQN(), "depends.yml"), d, fs.ModePerm)
 		if err != nil {
 			logger.Error("Error while writing package dependencies: ")
 			logger.Error(err)
-			return err
+			return usage, err
 		}
 
-		db := db.PackageDatabase{BackingFile: x10_util.PkgDb(root)}
-		err = db.Update(pkg, root, false)
+		err = pkgdb.Update(pkg, root, false)
 		if err != nil {
 			logger.Error("Error while updating package database: ")
 			logger.Error(err)
-			return err
+			return usage, err
 		}
 	}
 
-	return nil
+	return usage, nil
 }
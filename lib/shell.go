@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"runtime"
+	"strings"
+
+	"m0rg.dev/x10/runner"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_log"
+)
+
+// EnterShell starts an interactive shell in root. If pkg is given, the shell
+// gets the same environment that pkg's stages run with and starts in its
+// workdir.
+func EnterShell(pkg *spec.SpecLayer, root string, network bool) error {
+	logger := x10_log.Get("shell")
+
+	setup := []string{}
+	if pkg != nil {
+		logger = logger.WithField("package", pkg.GetFQN())
+		setup = append(setup, pkg.GetEnvironmentSetupScript(runtime.NumCPU()))
+		setup = append(setup, "cd \"$X10_WORKDIR\"")
+	}
+
+	opts, err := runner.NewOptions(pkg)
+	if err != nil {
+		return err
+	}
+	opts.Network = network
+
+	return runner.RunTargetShell(logger, root, strings.Join(setup, "\n"), opts)
+}
@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"m0rg.dev/x10/runner"
+	"m0rg.dev/x10/spec"
+)
+
+// Steps report their progress on stdout as stepMarker lines:
+//
+//	@@x10-step@@ start <name>
+//	@@x10-step@@ failed <status> <name>
+//	@@x10-step@@ done
+//
+// which stepTracker picks out of the stage's output.
+const stepMarker = "@@x10-step@@"
+
+// stepsScript runs each step in a subshell of its own, so a failing step
+// can be reported (or skipped past) by name. The bookkeeping is kept out of
+// the xtrace output.
+func stepsScript(steps []spec.SpecStep) string {
+	lines := []string{}
+	for _, step := range steps {
+		name := runner.ShellQuote(step.Name)
+		lines = append(lines,
+			"{ echo "+stepMarker+" start "+name+"; set +e; } 2>/dev/null",
+			"(",
+			"{ set -e; } 2>/dev/null",
+		)
+		if step.Dir != "" {
+			lines = append(lines, "cd "+strconv.Quote(step.Dir))
+		}
+
+		names := []string{}
+		for env_name := range step.Environment {
+			names = append(names, env_name)
+		}
+		sort.Strings(names)
+		for _, env_name := range names {
+			lines = append(lines, fmt.Sprintf("export %s=%s", env_name, strconv.Quote(step.Environment[env_name])))
+		}
+
+		on_failure := "exit $x10_status"
+		if step.ContinueOnError {
+			on_failure = ":"
+		}
+		lines = append(lines,
+			step.Command,
+			")",
+			"{ x10_status=$?; set -e; } 2>/dev/null",
+			"{ if [ $x10_status -ne 0 ]; then echo "+stepMarker+" failed $x10_status "+name+"; "+on_failure+"; else echo "+stepMarker+" done; fi; } 2>/dev/null",
+		)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stepTracker sits in front of a stage's log, turning step markers into
+// readable lines and remembering where the stage got to.
+type stepTracker struct {
+	logger *logrus.Entry
+	log    io.Writer
+	steps  map[string]spec.SpecStep
+
+	lock    sync.Mutex
+	running string   // the step that's started but not finished, if any
+	failed  []string // steps that failed, in order
+}
+
+func newStepTracker(logger *logrus.Entry, log io.Writer, steps []spec.SpecStep) *stepTracker {
+	t := &stepTracker{logger: logger, log: log, steps: map[string]spec.SpecStep{}}
+	for _, step := range steps {
+		t.steps[step.Name] = step
+	}
+	return t
+}
+
+func (t *stepTracker) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	if !strings.Contains(line, stepMarker) {
+		return t.log.Write(p)
+	}
+	if !strings.HasPrefix(line, stepMarker+" ") {
+		// Something else echoing a marker, e.g. the shell tracing one.
+		return len(p), nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	fields := strings.SplitN(strings.TrimPrefix(line, stepMarker+" "), " ", 3)
+	switch {
+	case fields[0] == "start" && len(fields) > 1:
+		t.running = strings.Join(fields[1:], " ")
+		fmt.Fprintf(t.log, "# step %s\n", t.running)
+	case fields[0] == "failed" && len(fields) == 3:
+		fmt.Fprintf(t.log, "# step %s failed with status %s\n", fields[2], fields[1])
+		if t.steps[fields[2]].ContinueOnError {
+			t.logger.Warnf("Step %s failed with status %s; continuing.", fields[2], fields[1])
+		}
+		t.running = ""
+		t.failed = append(t.failed, fields[2])
+	case fields[0] == "done":
+		t.running = ""
+	}
+	return len(p), nil
+}
+
+// wrap says which step an error from the stage's script came from, if it
+// came from one.
+func (t *stepTracker) wrap(err error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.running != "" {
+		// Stopped partway through, e.g. by a timeout.
+		return fmt.Errorf("step %s: %w", t.running, err)
+	}
+	if len(t.failed) > 0 {
+		last := t.failed[len(t.failed)-1]
+		if !t.steps[last].ContinueOnError {
+			return fmt.Errorf("step %s: %w", last, err)
+		}
+	}
+	return err
+}
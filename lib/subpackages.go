@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_log"
+)
+
+// SplitSubpackages moves the files each of pkg's subpackages claims out of
+// pkg's DESTDIR and into the subpackage's. A file goes to the first
+// subpackage with a pattern matching it or one of its parent directories.
+// Files that have already been moved are left alone, so it's safe to run
+// again when resuming.
+func SplitSubpackages(pkg spec.SpecLayer, root string) error {
+	logger := x10_log.Get("split").WithField("pkg", pkg.GetFQN())
+
+	type target struct {
+		destdir  string
+		patterns []*regexp.Regexp
+	}
+	targets := []target{}
+
+	for _, sub := range pkg.Subpackages {
+		subpkg, err := pkg.Subpackage(sub.Name)
+		if err != nil {
+			return err
+		}
+
+		t := target{destdir: filepath.Join(root, "destdir", subpkg.GetFQN())}
+		for _, pattern := range sub.Files {
+			re, err := globRegexp(pattern)
+			if err != nil {
+				return fmt.Errorf("subpackage %s: %w", sub.Name, err)
+			}
+			t.patterns = append(t.patterns, re)
+		}
+
+		err = os.MkdirAll(t.destdir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, t)
+	}
+
+	destdir := filepath.Join(root, "destdir", pkg.GetFQN())
+	moves := map[string]string{}
+
+	err := filepath.WalkDir(destdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(destdir, path)
+		if err != nil {
+			return err
+		}
+		if !strings.ContainsRune(rel, '/') {
+			// Top-level files are package metadata, not contents.
+			return nil
+		}
+
+		for _, t := range targets {
+			for _, re := range t.patterns {
+				if matchesPathOrParent(re, rel) {
+					moves[path] = filepath.Join(t.destdir, rel)
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for from, to := range moves {
+		logger.Debugf(" %s => %s", from, to)
+		err := os.MkdirAll(filepath.Dir(to), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("Moved %d file(s) into subpackages.", len(moves))
+	return nil
+}
+
+// globRegexp turns a file pattern into a regexp. * and ? don't match /, but
+// ** matches anything.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return nil, fmt.Errorf("empty file pattern")
+	}
+
+	re := strings.Builder{}
+	re.WriteString("^")
+	for idx := 0; idx < len(pattern); idx++ {
+		switch {
+		case strings.HasPrefix(pattern[idx:], "**"):
+			re.WriteString(".*")
+			idx++
+		case pattern[idx] == '*':
+			re.WriteString("[^/]*")
+		case pattern[idx] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[idx : idx+1]))
+		}
+	}
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
+
+func matchesPathOrParent(re *regexp.Regexp, path string) bool {
+	for {
+		if re.MatchString(path) {
+			return true
+		}
+		idx := strings.LastIndexByte(path, '/')
+		if idx < 0 {
+			return false
+		}
+		path = path[:idx]
+	}
+}
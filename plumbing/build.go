@@ -1,6 +1,14 @@
 package plumbing
 
 import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
 	"m0rg.dev/x10/conf"
 	"m0rg.dev/x10/db"
 	"m0rg.dev/x10/lib"
@@ -9,146 +17,363 @@ import (
 	"m0rg.dev/x10/x10_util"
 )
 
-func Build(name string) error {
+// Build runs the selected stages of a single package in root. Dependencies
+// are expected to have been built already (see Schedule); they're only
+// installed here.
+func Build(pkgdb db.PackageDatabase, root string, name string, sel StageSelection) error {
 	logger := x10_log.Get("build").WithField("pkg", name)
 
 	pkg, err := spec.LoadPackage(x10_util.PkgSrc(name))
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	root := conf.Get("build:target-root")
-	pkgdb := db.PackageDatabase{BackingFile: x10_util.PkgDb(root)}
 	contents, err := pkgdb.Read()
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	logger.Infof("Building: %s", pkg.GetFQN())
-	for _, stage := range *pkg.StageOrder {
-		// err := lib.RunStage(*pkg, stage)
-		// if err != nil {
-		// 	return err
-		// }
+	if pkg.StageOrder == nil {
+		return fmt.Errorf("%s has no stageorder", name)
+	}
+
+	hash, err := stageHash(contents, *pkg)
+	if err != nil {
+		return err
+	}
+
+	completed, err := CompletedStages(root, pkg.GetFQN(), hash)
+	if err != nil {
+		return err
+	}
+
+	// Stage markers stay in root either way; only the stages themselves run
+	// in the build root. A snapshot build root sits on one base for the
+	// whole build, so every stage gets all of the package's build and test
+	// dependencies.
+	build_root := root
+	var snapshot *buildRoot
+	if mode := conf.Get("build:snapshots"); mode != SnapshotsOff {
+		if mode != SnapshotsOverlay && mode != SnapshotsCopy && mode != SnapshotsAuto {
+			return fmt.Errorf("unknown snapshot mode %s", mode)
+		}
+
+		pkgs, err := resolveBuildRootDeps(logger, pkgdb, contents, pkg)
+		if err != nil {
+			return err
+		}
+
+		snapshot = openBuildRoot(logger, pkg.GetFQN(), mode)
+		defer snapshot.Close()
+		fresh, err := snapshot.Use(pkgdb, contents, pkgs)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			// Nothing an earlier attempt did is left to resume from.
+			completed = map[string]bool{}
+		}
+		build_root = snapshot.Path
+		logger.Infof("Build root: %s", build_root)
+	}
+
+	stages, err := selectStages(*pkg.StageOrder, completed, sel)
+	if err != nil {
+		return err
+	}
+
+	if len(stages) > 0 && stages[0] != (*pkg.StageOrder)[0] {
+		logger.Infof("Resuming: %s at %s -> %s", pkg.GetFQN(), stages[0], root)
+	} else {
+		logger.Infof("Building: %s -> %s", pkg.GetFQN(), root)
+	}
+
+	stats := db.PackageStats{Name: name}
+
+	// Otherwise, most stages share a dependency class, so resolve each class
+	// once and only touch the root when a stage needs a different set than
+	// the one before it.
+	resolved := map[string][]spec.SpecDbData{}
+	var installed []spec.SpecDbData
+
+	for idx, stage := range stages {
 		logger.Infof(stage)
 
-		outstanding := map[string]bool{}
-		if stage == "configure" || stage == "build" || stage == "install" {
-			logger.Infof("Finding dependencies (build).")
-			for _, atom := range pkg.Depends.Build {
-				fqn, err := contents.FindFQN(atom)
+		if snapshot == nil {
+			class := dependencyClass(stage)
+			pkgs, ok := resolved[class]
+			if !ok {
+				pkgs, err = resolveStageDeps(logger, pkgdb, contents, pkg, class)
 				if err != nil {
 					return err
 				}
-				outstanding[*fqn] = true
+				resolved[class] = pkgs
 			}
-		} else if stage == "test" {
-			logger.Infof("Finding dependencies (test).")
-			for _, atom := range pkg.Depends.Test {
-				fqn, err := contents.FindFQN(atom)
+
+			if idx > 0 && sameFQNs(pkgs, installed) {
+				logger.Info("Dependencies unchanged.")
+			} else {
+				err = installStageDeps(logger, pkgdb, contents, root, pkgs)
 				if err != nil {
 					return err
 				}
-				outstanding[*fqn] = true
+				installed = pkgs
 			}
 		}
 
-		pkgs, complete, err := pkgdb.Resolve(logger, outstanding)
+		usage, err := lib.RunStage(pkgdb, *pkg, stage, build_root)
+		stats.Stages = append(stats.Stages, db.StageStats{Stage: stage, Wall: usage.Wall, CPU: usage.CPU})
+		stats.Wall += usage.Wall
+		stats.CPU += usage.CPU
 		if err != nil {
+			if conf.GetBool("build:shell-on-failure") {
+				shellOnFailure(logger, pkg, stage, build_root)
+			}
 			return err
 		}
 
-		if !complete {
-			// TODO.
-			logger.Warn("incomplete")
+		err = MarkStageComplete(root, pkg.GetFQN(), stage, hash)
+		if err != nil {
+			return err
 		}
+	}
 
-		for _, dep := range pkgs {
-			logger.Infof("To install: " + dep.GetFQN())
-			if !dep.GeneratedValid {
-				err = Build(dep.Meta.Name)
-				if err != nil {
-					return err
-				}
-			}
+	if len(stages) > 0 && stages[len(stages)-1] == (*pkg.StageOrder)[len(*pkg.StageOrder)-1] {
+		err = recordBuildStats(pkgdb, build_root, pkg.GetFQN(), stats)
+		if err != nil {
+			logger.Warnf("Couldn't record build statistics: %s", err)
 		}
-
-		if conf.GetBool("build:reset") {
-			logger.Info("Ensuring package state.")
-
-			world, err := GetWorld(root)
+		err = lib.DiscardPristineTree(*pkg, build_root)
+		if err != nil {
+			return err
+		}
+		if snapshot != nil {
+			err = snapshot.Discard()
 			if err != nil {
 				return err
 			}
+		}
+		return ClearStageMarkers(root, pkg.GetFQN())
+	}
 
-			fqn, err := contents.FindFQN("virtual/base-minimal")
-			if err != nil {
-				return err
-			}
+	return nil
+}
 
-			world.Clear()
-			world.Mark(*fqn)
-			for _, dep := range pkgs {
-				world.Mark(dep.GetFQN())
+// FindBuildRoot returns the root pkg's stages ran in during its unfinished
+// build in root: its snapshot build root if it has one, or else the job root
+// (see JobRoot) with its stage markers. Without either, it's root. A snapshot
+// build root stays mounted until release is called.
+func FindBuildRoot(logger *logrus.Entry, root string, pkg spec.SpecLayer) (string, func(), error) {
+	snapshot, err := reopenBuildRoot(logger, pkg.GetFQN())
+	if err != nil {
+		return "", nil, err
+	}
+	if snapshot != nil {
+		return snapshot.Path, func() { snapshot.Close() }, nil
+	}
+
+	for slot := 0; ; slot++ {
+		job_root := JobRoot(root, slot)
+		if _, err := os.Stat(job_root); err != nil {
+			break
+		}
+		if _, err := os.Stat(stageMarkerDir(job_root, pkg.GetFQN())); err == nil {
+			return job_root, func() {}, nil
+		}
+	}
+	return root, func() {}, nil
+}
+
+// dependencyClass says which of a package's dependencies a stage needs:
+// "build", "test", or "" for none.
+func dependencyClass(stage string) string {
+	switch stage {
+	case "configure", "build", "install":
+		return "build"
+	case "test":
+		return "test"
+	}
+	return ""
+}
+
+// resolveBuildRootDeps resolves the dependencies of every class pkg's stages
+// need, for a build root that has to hold them all at once.
+func resolveBuildRootDeps(logger *logrus.Entry, pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, pkg *spec.SpecLayer) ([]spec.SpecDbData, error) {
+	rc := []spec.SpecDbData{}
+	seen := map[string]bool{}
+	classes := map[string]bool{}
+	for _, stage := range *pkg.StageOrder {
+		class := dependencyClass(stage)
+		if class == "" || classes[class] {
+			continue
+		}
+		classes[class] = true
+
+		pkgs, err := resolveStageDeps(logger, pkgdb, contents, pkg, class)
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range pkgs {
+			if !seen[dep.GetFQN()] {
+				seen[dep.GetFQN()] = true
+				rc = append(rc, dep)
 			}
-			plan, err := CheckPlan(logger, pkgdb, root, world)
+		}
+	}
+	return rc, nil
+}
+
+func resolveStageDeps(logger *logrus.Entry, pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, pkg *spec.SpecLayer, class string) ([]spec.SpecDbData, error) {
+	outstanding := map[string]bool{}
+
+	atoms := []string{}
+	if class == "build" {
+		logger.Infof("Finding dependencies (build).")
+		atoms = pkg.Depends.Build
+	} else if class == "test" {
+		logger.Infof("Finding dependencies (test).")
+		atoms = pkg.Depends.Test
+	}
+
+	for _, atom := range atoms {
+		fqn, err := contents.FindFQN(atom)
+		if err != nil {
+			return nil, err
+		}
+		outstanding[*fqn] = true
+	}
+
+	pkgs, complete, err := pkgdb.Resolve(logger, outstanding)
+	if err != nil {
+		return nil, err
+	}
+
+	if !complete {
+		// TODO.
+		logger.Warn("incomplete")
+	}
+
+	for _, dep := range pkgs {
+		logger.Infof("To install: " + dep.GetFQN())
+		if !dep.GeneratedValid {
+			return nil, fmt.Errorf("dependency %s has not been built", dep.GetFQN())
+		}
+	}
+
+	return pkgs, nil
+}
+
+func installStageDeps(logger *logrus.Entry, pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, root string, pkgs []spec.SpecDbData) error {
+	if !conf.GetBool("build:reset") {
+		for _, dep := range pkgs {
+			err := lib.Install(pkgdb, dep, root)
 			if err != nil {
 				return err
 			}
+		}
+		return nil
+	}
+	return reconcileRoot(logger, pkgdb, contents, root, pkgs)
+}
 
-			for _, op := range plan {
-				if op.Op == db.ActionInstall {
-					err := lib.Install(pkgdb, contents.Packages[op.Fqn], root)
-					if err != nil {
-						return err
-					}
-				} else {
-					err := lib.Remove(pkgdb, contents.Packages[op.Fqn], root)
-					if err != nil {
-						return err
-					}
-				}
-			}
+// reconcileRoot installs and removes packages in root until it holds exactly
+// virtual/base-minimal and pkgs (plus their dependencies).
+func reconcileRoot(logger *logrus.Entry, pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, root string, pkgs []spec.SpecDbData) error {
+	logger.Info("Ensuring package state.")
 
-			err = world.Write()
+	world, err := GetWorld(root)
+	if err != nil {
+		return err
+	}
+
+	fqn, err := contents.FindFQN("virtual/base-minimal")
+	if err != nil {
+		return err
+	}
+
+	world.Clear()
+	world.Mark(*fqn)
+	for _, dep := range pkgs {
+		world.Mark(dep.GetFQN())
+	}
+	plan, err := CheckPlan(logger, pkgdb, root, world)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range plan {
+		if op.Op == db.ActionInstall {
+			err := lib.Install(pkgdb, contents.Packages[op.Fqn], root)
 			if err != nil {
 				return err
 			}
 		} else {
-			for _, dep := range pkgs {
-				err := lib.Install(pkgdb, dep, root)
-				if err != nil {
-					return err
-				}
+			err := lib.Remove(pkgdb, contents.Packages[op.Fqn], root)
+			if err != nil {
+				return err
 			}
 		}
+	}
 
-		err = lib.RunStage(*pkg, stage, root)
-		if err != nil {
-			return err
+	return world.Write()
+}
+
+func sameFQNs(a []spec.SpecDbData, b []spec.SpecDbData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	fqns := map[string]bool{}
+	for _, pkg := range a {
+		fqns[pkg.GetFQN()] = true
+	}
+	for _, pkg := range b {
+		if !fqns[pkg.GetFQN()] {
+			return false
 		}
 	}
+	return true
+}
 
-	logger.Infof("Building dependencies (run).")
-	for _, atom := range pkg.Depends.Run {
-		fqn, err := contents.FindFQN(atom)
-		if err != nil {
-			return err
-		}
-		dep, err := pkgdb.Get(*fqn)
-		if err != nil {
-			return err
-		}
+func recordBuildStats(pkgdb db.PackageDatabase, root string, fqn string, stats db.PackageStats) error {
+	stats.Finished = time.Now()
 
-		if !dep.GeneratedValid {
-			err = Build(atom)
-			if err != nil {
-				return err
+	binpkg, err := os.Stat(filepath.Join(conf.Get("repo"), "binpkgs", fqn+".tar.xz"))
+	if err == nil {
+		stats.BinpkgSize = binpkg.Size()
+	}
+
+	filepath.WalkDir(filepath.Join(root, "destdir", fqn), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			info, err := d.Info()
+			if err == nil {
+				stats.InstalledSize += info.Size()
 			}
 		}
+		return nil
+	})
+
+	statsdb := pkgdb.Stats()
+	return statsdb.RecordBuild(fqn, stats)
+}
+
+// Only one job gets the terminal at a time.
+var shell_lock sync.Mutex
+
+func shellOnFailure(logger *logrus.Entry, pkg *spec.SpecLayer, stage string, root string) {
+	shell_lock.Lock()
+	defer shell_lock.Unlock()
+
+	logger.Warnf("Stage %s failed; entering a shell in %s.", stage, root)
+	network, err := lib.StageNetwork(*pkg, stage)
+	if err != nil {
+		logger.Warn(err)
+		return
 	}
 
-	return nil
+	err = lib.EnterShell(pkg, root, network)
+	if err != nil {
+		logger.Warn(err)
+	}
 }
 
 // func _Build(pkgdb db.PackageDatabase, pkg spec.SpecLayer) error {
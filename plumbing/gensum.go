@@ -0,0 +1,255 @@
+package plumbing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_log"
+	"m0rg.dev/x10/x10_util"
+)
+
+// GenSum computes checksums for the sources listed directly in a package's
+// spec file and rewrites the file in place. Only the checksum values are
+// touched, so comments and key ordering survive.
+func GenSum(name string) error {
+	logger := x10_log.Get("gensum").WithField("pkg", name)
+	pkgsrc := x10_util.PkgSrc(name)
+
+	pkg, err := spec.LoadPackage(pkgsrc)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(pkgsrc)
+	if err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(pkgsrc)
+	if err != nil {
+		return err
+	}
+
+	doc := yaml.Node{}
+	err = yaml.Unmarshal(raw, &doc)
+	if err != nil {
+		return err
+	}
+
+	sources := findSourcesNode(&doc)
+	if sources == nil {
+		logger.Info("(no sources)")
+		return nil
+	}
+
+	lines := strings.Split(string(raw), "\n")
+	edits := []sourceEdit{}
+
+	for idx, source := range sources.Content {
+		if source.Kind != yaml.MappingNode || source.Style&yaml.FlowStyle != 0 {
+			return fmt.Errorf("%s:%d: can't rewrite non-block source entry", pkgsrc, source.Line)
+		}
+
+		url_key, url_node := mappingEntry(source, "url")
+		if url_node == nil {
+			return fmt.Errorf("%s:%d: source has no url", pkgsrc, source.Line)
+		}
+
+		logger.Infof("Fetching: %s", url_node.Value)
+		source_url, err := pkg.Interpolate(url_node.Value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", pkgsrc, url_node.Line, err)
+		}
+		sum, err := hashSource(expandSourceURL(*pkg, source_url))
+		if err != nil {
+			return err
+		}
+		logger.Infof(" => %s", sum)
+
+		_, checksum_node := mappingEntry(source, "checksum")
+		if checksum_node != nil {
+			if checksum_node.Value == sum {
+				continue
+			}
+			edits = append(edits, sourceEdit{idx, checksum_node.Line, checksum_node, url_key, sum})
+		} else {
+			edits = append(edits, sourceEdit{idx, url_node.Line, nil, url_key, sum})
+		}
+	}
+
+	if len(edits) == 0 {
+		logger.Info("(checksums up to date)")
+		return nil
+	}
+
+	// Work from the bottom up so inserted lines don't shift later edits.
+	sort.Slice(edits, func(i, j int) bool { return edits[i].line > edits[j].line })
+
+	for _, edit := range edits {
+		lines, err = edit.apply(lines)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", pkgsrc, edit.line, err)
+		}
+		logger.Infof("Updated checksum for source %d", edit.index)
+	}
+
+	return ioutil.WriteFile(pkgsrc, []byte(strings.Join(lines, "\n")), stat.Mode())
+}
+
+type sourceEdit struct {
+	index    int
+	line     int
+	checksum *yaml.Node
+	url_key  *yaml.Node
+	sum      string
+}
+
+func (edit sourceEdit) apply(lines []string) ([]string, error) {
+	if edit.checksum == nil {
+		// Add a checksum key right after the url, at the same indentation.
+		indent := strings.Repeat(" ", edit.url_key.Column-1)
+		rc := append([]string{}, lines[:edit.line]...)
+		rc = append(rc, indent+"checksum: "+edit.sum)
+		return append(rc, lines[edit.line:]...), nil
+	}
+
+	line := lines[edit.line-1]
+	start := edit.checksum.Column - 1
+	token := edit.checksum.Value
+	replacement := edit.sum
+	switch edit.checksum.Style {
+	case yaml.DoubleQuotedStyle:
+		token = strconv.Quote(token)
+		replacement = strconv.Quote(replacement)
+	case yaml.SingleQuotedStyle:
+		token = "'" + token + "'"
+		replacement = "'" + replacement + "'"
+	}
+
+	if start+len(token) > len(line) || line[start:start+len(token)] != token {
+		return nil, fmt.Errorf("can't locate existing checksum %s", edit.checksum.Value)
+	}
+
+	lines[edit.line-1] = line[:start] + replacement + line[start+len(token):]
+	return lines, nil
+}
+
+func findSourcesNode(doc *yaml.Node) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil
+	}
+
+	_, pkg := mappingEntry(doc.Content[0], "package")
+	if pkg == nil {
+		return nil
+	}
+
+	_, sources := mappingEntry(pkg, "sources")
+	if sources == nil || sources.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return sources
+}
+
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// Source URLs from before interpolation refer to the package's metadata
+// through the variables the fetch stage's shell has, like $X10_META_VERSION.
+var legacySourceVarRegexp = regexp.MustCompile(`\$\{(X10_META_[A-Za-z0-9_]*)\}|\$(X10_META_[A-Za-z0-9_]*)`)
+
+// expandSourceURL fills in the legacy metadata variables in a source URL,
+// since they're normally only expanded by the fetch stage's shell. Anything
+// else is left as it is.
+func expandSourceURL(pkg spec.SpecLayer, raw string) string {
+	unpack_dir := pkg.Meta.Name
+	if pkg.Meta.UnpackDir != nil {
+		unpack_dir = *pkg.Meta.UnpackDir
+	}
+	values := map[string]string{
+		"X10_META_NAME":        pkg.Meta.Name,
+		"X10_META_VERSION":     pkg.Meta.Version,
+		"X10_META_REVISION":    strconv.Itoa(pkg.Meta.Revision),
+		"X10_META_MAINTAINER":  pkg.Meta.Maintainer,
+		"X10_META_HOMEPAGE":    pkg.Meta.Homepage,
+		"X10_META_LICENSE":     pkg.Meta.License,
+		"X10_META_DESCRIPTION": pkg.Meta.Description,
+		"X10_META_UNPACK_DIR":  unpack_dir,
+	}
+
+	return legacySourceVarRegexp.ReplaceAllStringFunc(raw, func(ref string) string {
+		match := legacySourceVarRegexp.FindStringSubmatch(ref)
+		name := match[1] + match[2]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+func hashSource(source string) (string, error) {
+	var reader io.ReadCloser
+
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		resp, err := http.Get(source)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("GET %s: %s", source, resp.Status)
+		}
+		reader = resp.Body
+	case "file", "":
+		path := parsed.Path
+		if !filepath.IsAbs(path) {
+			// Relative paths are taken from the same files directory that
+			// stages see as /pkgfiles.
+			path = filepath.Join(conf.Get("packages"), "files", path)
+		}
+		reader, err = os.Open(path)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("don't know how to fetch %s", source)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,474 @@
+package plumbing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/lib"
+	"m0rg.dev/x10/runner"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/trigger"
+	"m0rg.dev/x10/x10_util"
+)
+
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+type LintProblem struct {
+	File     string
+	Line     int // 0 if the problem isn't tied to a particular line
+	Column   int
+	Severity string
+	Message  string
+}
+
+func (problem LintProblem) String() string {
+	if problem.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", problem.File, problem.Severity, problem.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", problem.File, problem.Line, problem.Column, problem.Severity, problem.Message)
+}
+
+// lintFile is one file making up a package, in the order LoadPackage
+// composites them (layers first, the package itself last).
+type lintFile struct {
+	path string
+	doc  *yaml.Node
+}
+
+type linter struct {
+	files    []lintFile
+	problems []LintProblem
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Lint checks a package spec, with its layers, for problems that would
+// otherwise only turn up partway through a build. provided reports whether a
+// dependency atom names something that can be installed.
+func Lint(name string, provided func(atom string) bool) []LintProblem {
+	l := &linter{}
+	pkgsrc := x10_util.PkgSrc(name)
+
+	if !l.loadFiles(pkgsrc, nil, map[string]bool{}) {
+		return l.problems
+	}
+
+	pkg, err := spec.LoadPackage(pkgsrc)
+	if err != nil {
+		l.report(LintError, pkgsrc, nil, err.Error())
+		return l.problems
+	}
+
+	l.checkMeta(name, pkg)
+	l.checkStages(pkg)
+	l.checkSources()
+	l.checkDepends(pkg, provided)
+	l.checkSubpackages(pkg, provided)
+	l.checkOptions(pkg, provided)
+	l.checkPatches(pkg)
+
+	trigger_names := []string{}
+	for trigger_name := range pkg.TriggerData {
+		trigger_names = append(trigger_names, trigger_name)
+	}
+	sort.Strings(trigger_names)
+	for _, trigger_name := range trigger_names {
+		if !trigger.IsRegistered(trigger_name) {
+			l.reportAt(LintError, fmt.Sprintf("unknown trigger %s", trigger_name), "triggerdata", trigger_name)
+		}
+	}
+
+	return l.problems
+}
+
+// loadFiles parses path and, first, every layer it uses, whether or not
+// their conditions hold. Files that don't fit the spec schema are reported,
+// and stop the rest of the checks.
+func (l *linter) loadFiles(path string, chain []string, seen map[string]bool) bool {
+	for _, used := range chain {
+		if used == path {
+			l.report(LintError, path, nil, "layer cycle through this file")
+			return false
+		}
+	}
+	if seen[path] {
+		return true
+	}
+	seen[path] = true
+	chain = append(append([]string{}, chain...), path)
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.report(LintError, path, nil, err.Error())
+		return false
+	}
+
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(raw, doc)
+	if err != nil {
+		l.reportYAMLError(path, err)
+		return false
+	}
+
+	// The schema is whatever the strict decoder LoadPackage uses accepts.
+	parsed := spec.Spec{}
+	err = yaml2.UnmarshalStrict(raw, &parsed)
+	if err != nil {
+		l.reportYAMLError(path, err)
+		return false
+	}
+
+	if parsed.Package == nil {
+		l.report(LintError, path, nil, "no package key")
+		return false
+	}
+
+	ok := true
+	for _, layer := range parsed.Layers {
+		ok = l.loadFiles(filepath.Join(conf.Get("packages"), "layers", layer.Name+".yml"), chain, seen) && ok
+	}
+
+	l.files = append(l.files, lintFile{path, doc})
+	return ok
+}
+
+func (l *linter) reportYAMLError(path string, err error) {
+	found := false
+	for _, line := range strings.Split(err.Error(), "\n") {
+		match := yamlErrorLine.FindStringSubmatch(line)
+		if match != nil {
+			line_number, _ := strconv.Atoi(match[1])
+			l.problems = append(l.problems, LintProblem{path, line_number, 1, LintError, match[2]})
+			found = true
+		}
+	}
+	if !found {
+		l.report(LintError, path, nil, err.Error())
+	}
+}
+
+func (l *linter) report(severity string, path string, node *yaml.Node, message string) {
+	problem := LintProblem{File: path, Severity: severity, Message: message}
+	if node != nil {
+		problem.Line = node.Line
+		problem.Column = node.Column
+	}
+	l.problems = append(l.problems, problem)
+}
+
+// reportAt reports a problem with the composited package at the key path
+// under package: that ends up deciding it, i.e. in the last file to set it.
+// If no file sets the whole path, the closest enclosing key in the package
+// file is used.
+func (l *linter) reportAt(severity string, message string, keys ...string) {
+	pkgfile := l.files[len(l.files)-1]
+	best := l.lookup(pkgfile, keys)
+
+	for idx := len(l.files) - 1; idx >= 0; idx-- {
+		node := l.lookup(l.files[idx], keys)
+		if node != nil && node.depth == len(keys) {
+			l.report(severity, l.files[idx].path, node.node, message)
+			return
+		}
+	}
+
+	if best != nil {
+		l.report(severity, pkgfile.path, best.node, message)
+	} else {
+		l.report(severity, pkgfile.path, nil, message)
+	}
+}
+
+type lookupResult struct {
+	node  *yaml.Node
+	depth int
+}
+
+// lookup follows keys as far as it can under file's package: key, returning
+// the last key node found.
+func (l *linter) lookup(file lintFile, keys []string) *lookupResult {
+	if len(file.doc.Content) == 0 {
+		return nil
+	}
+
+	key, node := mappingEntry(file.doc.Content[0], "package")
+	if key == nil {
+		return nil
+	}
+
+	rc := &lookupResult{key, 0}
+	for _, want := range keys {
+		key, node = mappingEntry(node, want)
+		if key == nil {
+			break
+		}
+		rc = &lookupResult{key, rc.depth + 1}
+	}
+	return rc
+}
+
+func (l *linter) checkMeta(name string, pkg *spec.SpecLayer) {
+	if pkg.Meta == nil {
+		l.reportAt(LintError, "no meta", "meta")
+		return
+	}
+
+	if pkg.Meta.Name == "" {
+		l.reportAt(LintError, "meta has no name", "meta", "name")
+	} else if pkg.Meta.Name != name {
+		l.reportAt(LintError, fmt.Sprintf("meta name %s doesn't match the file name %s", pkg.Meta.Name, name), "meta", "name")
+	}
+
+	if pkg.Meta.Version == "" {
+		l.reportAt(LintError, "meta has no version", "meta", "version")
+	}
+}
+
+func (l *linter) checkStages(pkg *spec.SpecLayer) {
+	if pkg.StageOrder == nil {
+		l.reportAt(LintError, "no stageorder", "stageorder")
+	} else {
+		seen := map[string]bool{}
+		for _, stage := range *pkg.StageOrder {
+			if seen[stage] {
+				l.reportAt(LintError, fmt.Sprintf("stage %s is listed twice in stageorder", stage), "stageorder")
+			}
+			seen[stage] = true
+
+			// x10 runs the patch stage itself, so it doesn't need defining.
+			if pkg.Stages[stage] == nil && stage != lib.PatchStage {
+				l.reportAt(LintError, fmt.Sprintf("stage %s is in stageorder but never defined", stage), "stageorder")
+			}
+		}
+
+		for _, stage := range sortedStageNames(pkg.Stages) {
+			if !seen[stage] {
+				l.reportAt(LintWarning, fmt.Sprintf("stage %s is defined but not in stageorder, so it never runs", stage), "stages", stage)
+			}
+		}
+	}
+
+	for _, name := range sortedStageNames(pkg.Stages) {
+		stage := pkg.Stages[name]
+		if stage.Script == nil && len(stage.Steps) == 0 && name != lib.PatchStage {
+			l.reportAt(LintWarning, fmt.Sprintf("stage %s has no script", name), "stages", name)
+		}
+
+		// Steps with the same name replace each other, so names only need
+		// to be there.
+		for _, step := range stage.Steps {
+			if step.Name == "" {
+				l.reportAt(LintError, fmt.Sprintf("stage %s has a step with no name", name), "stages", name, "steps")
+			} else if strings.Contains(step.Name, "\n") {
+				l.reportAt(LintError, fmt.Sprintf("stage %s: step name %q has a line break", name, step.Name), "stages", name, "steps")
+			}
+
+			if strings.TrimSpace(step.Command) == "" {
+				l.reportAt(LintError, fmt.Sprintf("stage %s: step %s has no command", name, step.Name), "stages", name, "steps")
+			}
+		}
+
+		_, err := runner.StageLimits(stage)
+		if err != nil {
+			l.reportAt(LintError, fmt.Sprintf("stage %s: %s", name, err), "stages", name)
+		}
+	}
+}
+
+// checkSources looks at each file's sources directly, since they're simply
+// concatenated.
+func (l *linter) checkSources() {
+	for _, file := range l.files {
+		result := l.lookup(file, []string{"sources"})
+		if result == nil || result.depth != 1 {
+			continue
+		}
+
+		_, sources := mappingEntry(file.doc.Content[0], "package")
+		_, sources = mappingEntry(sources, "sources")
+		if sources.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		for _, source := range sources.Content {
+			_, url := mappingEntry(source, "url")
+			if url == nil || url.Value == "" {
+				l.report(LintError, file.path, source, "source has no url")
+				continue
+			}
+
+			_, checksum := mappingEntry(source, "checksum")
+			if checksum == nil || checksum.Value == "" {
+				l.report(LintError, file.path, source, fmt.Sprintf("source %s has no checksum", url.Value))
+			}
+		}
+	}
+}
+
+func (l *linter) checkDepends(pkg *spec.SpecLayer, provided func(atom string) bool) {
+	classes := []struct {
+		key   string
+		atoms []string
+	}{
+		{"hostbuild", pkg.Depends.HostBuild},
+		{"build", pkg.Depends.Build},
+		{"test", pkg.Depends.Test},
+		{"run", pkg.Depends.Run},
+	}
+
+	for _, class := range classes {
+		for _, atom := range class.atoms {
+			if provided(atom) {
+				continue
+			}
+
+			message := fmt.Sprintf("nothing provides %s dependency %s", class.key, atom)
+			if !l.reportDependency(class.key, atom, message) {
+				l.reportAt(LintError, message, "depends", class.key)
+			}
+		}
+	}
+}
+
+// reportDependency reports a problem at the list entry for atom, if one of
+// the files has it.
+func (l *linter) reportDependency(class string, atom string, message string) bool {
+	for idx := len(l.files) - 1; idx >= 0; idx-- {
+		file := l.files[idx]
+		result := l.lookup(file, []string{"depends", class})
+		if result == nil || result.depth != 2 {
+			continue
+		}
+
+		_, node := mappingEntry(file.doc.Content[0], "package")
+		_, node = mappingEntry(node, "depends")
+		_, node = mappingEntry(node, class)
+		for _, item := range node.Content {
+			if item.Value == atom {
+				l.report(LintError, file.path, item, message)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedStageNames(stages map[string]*spec.SpecStage) []string {
+	names := []string{}
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l *linter) checkSubpackages(pkg *spec.SpecLayer, provided func(atom string) bool) {
+	seen := map[string]bool{}
+	if pkg.Meta != nil {
+		seen[pkg.Meta.Name] = true
+	}
+
+	for _, sub := range pkg.Subpackages {
+		if sub.Name == "" {
+			l.reportAt(LintError, "subpackage has no name", "subpackages")
+			continue
+		}
+		if seen[sub.Name] {
+			l.reportAt(LintError, fmt.Sprintf("subpackage name %s is already taken", sub.Name), "subpackages")
+		}
+		seen[sub.Name] = true
+
+		if len(sub.Files) == 0 {
+			l.reportAt(LintWarning, fmt.Sprintf("subpackage %s has no files", sub.Name), "subpackages")
+		}
+
+		if sub.Meta != nil && sub.Meta.Name != "" && sub.Meta.Name != sub.Name {
+			l.reportAt(LintWarning, fmt.Sprintf("subpackage %s: meta.name is ignored", sub.Name), "subpackages")
+		}
+		if sub.Meta != nil && sub.Meta.UnpackDir != nil {
+			l.reportAt(LintWarning, fmt.Sprintf("subpackage %s: meta.unpackdir is ignored", sub.Name), "subpackages")
+		}
+
+		for _, atom := range sub.Depends {
+			if !provided(atom) {
+				l.reportAt(LintError, fmt.Sprintf("nothing provides subpackage %s dependency %s", sub.Name, atom), "subpackages")
+			}
+		}
+
+		for trigger_name := range sub.TriggerData {
+			if !trigger.IsRegistered(trigger_name) {
+				l.reportAt(LintError, fmt.Sprintf("subpackage %s: unknown trigger %s", sub.Name, trigger_name), "subpackages")
+			}
+		}
+	}
+}
+
+var optionNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_]*$`)
+
+func (l *linter) checkOptions(pkg *spec.SpecLayer, provided func(atom string) bool) {
+	seen := map[string]bool{}
+	for _, option := range pkg.Options {
+		if !optionNameRegexp.MatchString(option.Name) {
+			l.reportAt(LintError, fmt.Sprintf("option name %q should match %s", option.Name, optionNameRegexp), "options")
+		}
+		if seen[option.Name] {
+			l.reportAt(LintError, fmt.Sprintf("option %s is declared twice", option.Name), "options")
+		}
+		seen[option.Name] = true
+
+		for _, atoms := range [][]string{option.Depends.HostBuild, option.Depends.Build, option.Depends.Test, option.Depends.Run} {
+			for _, atom := range atoms {
+				if !provided(atom) {
+					l.reportAt(LintError, fmt.Sprintf("nothing provides option %s dependency %s", option.Name, atom), "options")
+				}
+			}
+		}
+
+		for stage_name := range option.Stages {
+			if _, ok := pkg.Stages[stage_name]; !ok {
+				l.reportAt(LintWarning, fmt.Sprintf("option %s adds to stage %s, which the package doesn't have", option.Name, stage_name), "options")
+			}
+		}
+	}
+}
+
+func (l *linter) checkPatches(pkg *spec.SpecLayer) {
+	if pkg.Patches == nil || len(*pkg.Patches) == 0 {
+		return
+	}
+
+	has_stage := false
+	if pkg.StageOrder != nil {
+		for _, stage := range *pkg.StageOrder {
+			has_stage = has_stage || stage == lib.PatchStage
+		}
+	}
+	if !has_stage {
+		l.reportAt(LintWarning, fmt.Sprintf("patches are never applied: stageorder has no %s stage", lib.PatchStage), "patches")
+	}
+	if pkg.Workdir == "" {
+		l.reportAt(LintError, "patches need a workdir to apply to", "patches")
+	}
+
+	for _, patch := range *pkg.Patches {
+		path := filepath.Join(conf.Get("packages"), "files", patch.File)
+		if _, err := os.Stat(path); err != nil {
+			l.reportAt(LintError, fmt.Sprintf("patch %s: %s", patch.File, err), "patches")
+		}
+		if patch.StripLevel() < 0 {
+			l.reportAt(LintError, fmt.Sprintf("patch %s: negative strip level", patch.File), "patches")
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package plumbing
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/spec"
+	"m0rg.dev/x10/x10_log"
+	"m0rg.dev/x10/x10_util"
+)
+
+type ScheduleOptions struct {
+	Jobs      int  // number of packages to build at once
+	KeepGoing bool // keep building unrelated packages after a failure
+	Force     bool // build the requested packages even if they're up to date
+
+	// Stages to run for the requested packages. Dependencies always get
+	// every stage, but still honour Stages.Resume.
+	Stages StageSelection
+}
+
+type BuildState int
+
+const (
+	StatePending BuildState = iota
+	StateRunning
+	StateBuilt
+	StateSkipped
+	StateFailed
+)
+
+func (state BuildState) String() string {
+	switch state {
+	case StatePending:
+		return "pending"
+	case StateRunning:
+		return "running"
+	case StateBuilt:
+		return "built"
+	case StateSkipped:
+		return "skipped"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+type BuildResult struct {
+	Name   string
+	State  BuildState
+	Reason string
+	Err    error
+}
+
+const (
+	reasonUpToDate = "already built"
+	reasonCycle    = "dependency cycle"
+)
+
+type buildNode struct {
+	BuildResult
+	target   bool     // explicitly requested, rather than pulled in as a dependency
+	requires []string // names that have to be built before this one
+	computed int      // generation requires was computed in
+
+	started  time.Time
+	finished time.Time
+}
+
+type buildDone struct {
+	name string
+	slot int
+	err  error
+}
+
+type scheduler struct {
+	logger *logrus.Entry
+	pkgdb  db.PackageDatabase
+	root   string
+	opts   ScheduleOptions
+
+	nodes    map[string]*buildNode
+	order    []string
+	specs    map[string]*spec.SpecLayer
+	slots    []bool // true if the slot's root is in use
+	running  int
+	stopping bool
+
+	// Bumped whenever the database may have changed, so requirements get
+	// recomputed.
+	generation int
+}
+
+// JobRoot returns the target root used by build slot n. Slot 0 is the target
+// root itself, so a single-job build behaves exactly like an unscheduled one.
+func JobRoot(root string, slot int) string {
+	if slot == 0 {
+		return root
+	}
+	return root + "." + strconv.Itoa(slot)
+}
+
+// Schedule builds the named packages and everything they (transitively)
+// depend on that hasn't been built yet. Packages whose dependencies are all
+// available are built in parallel, each in its own job root, up to
+// opts.Jobs at a time.
+//
+// The dependency graph is recomputed every time a package finishes, since a
+// fresh build can surface generated dependencies that weren't known before.
+func Schedule(pkgdb db.PackageDatabase, root string, names []string, opts ScheduleOptions) ([]BuildResult, error) {
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+
+	s := scheduler{
+		logger:     x10_log.Get("schedule"),
+		pkgdb:      pkgdb,
+		root:       root,
+		opts:       opts,
+		nodes:      map[string]*buildNode{},
+		specs:      map[string]*spec.SpecLayer{},
+		slots:      make([]bool, opts.Jobs),
+		generation: 1,
+	}
+
+	contents, err := pkgdb.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		fqn, err := contents.FindFQN(name)
+		if err != nil {
+			return nil, err
+		}
+		pkg := contents.Packages[*fqn]
+
+		node := s.add(pkg.SpecName())
+		node.target = true
+		if pkg.GeneratedValid && !opts.Force && !opts.Stages.IsPartial() {
+			node.State = StateSkipped
+			node.Reason = reasonUpToDate
+		}
+	}
+
+	started := time.Now()
+	done := make(chan buildDone)
+
+	for {
+		if !s.stopping {
+			err := s.startReady(done)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if s.running == 0 {
+			break
+		}
+
+		result := <-done
+		s.finish(result)
+	}
+
+	for _, name := range s.order {
+		node := s.nodes[name]
+		if node.State == StatePending {
+			node.State = StateSkipped
+			if s.stopping {
+				node.Reason = "build stopped"
+			} else {
+				node.Reason = reasonCycle
+			}
+		}
+	}
+
+	s.recordRun(started, names)
+
+	results := []BuildResult{}
+	failed := 0
+	for _, name := range s.order {
+		results = append(results, s.nodes[name].BuildResult)
+		if s.nodes[name].State == StateFailed {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d package(s) failed to build", failed)
+	}
+
+	for _, result := range results {
+		if result.State == StateSkipped && result.Reason == reasonCycle {
+			return results, errors.New("dependency cycle between remaining packages")
+		}
+	}
+
+	return results, nil
+}
+
+func (s *scheduler) add(name string) *buildNode {
+	node, ok := s.nodes[name]
+	if !ok {
+		node = &buildNode{BuildResult: BuildResult{Name: name, State: StatePending}}
+		s.nodes[name] = node
+		s.order = append(s.order, name)
+	}
+	return node
+}
+
+func (s *scheduler) loadSpec(name string) (*spec.SpecLayer, error) {
+	pkg, ok := s.specs[name]
+	if !ok {
+		var err error
+		pkg, err = spec.LoadPackage(x10_util.PkgSrc(name))
+		if err != nil {
+			return nil, err
+		}
+		s.specs[name] = pkg
+	}
+	return pkg, nil
+}
+
+// requirements lists the unbuilt packages that have to exist before name can
+// be built, i.e. everything its build and test stages will install.
+func (s *scheduler) requirements(contents *db.PackageDatabaseContents, name string) ([]string, error) {
+	pkg, err := s.loadSpec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	outstanding := map[string]bool{}
+	for _, atom := range append(append([]string{}, pkg.Depends.Build...), pkg.Depends.Test...) {
+		fqn, err := contents.FindFQN(atom)
+		if err != nil {
+			return nil, err
+		}
+		outstanding[*fqn] = true
+	}
+
+	deps, _, err := contents.Resolve(s.logger.WithField("pkg", name), outstanding)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := []string{}
+	for _, dep := range deps {
+		if !dep.GeneratedValid && dep.SpecName() != name {
+			rc = append(rc, dep.SpecName())
+		}
+	}
+	return rc, nil
+}
+
+func (s *scheduler) startReady(done chan buildDone) error {
+	contents, err := s.pkgdb.Read()
+	if err != nil {
+		return err
+	}
+
+	// Adding requirements can add new nodes, so keep going until the set
+	// settles.
+	for changed := true; changed; {
+		changed = false
+		for _, name := range s.order {
+			node := s.nodes[name]
+			if node.State != StatePending || node.computed == s.generation {
+				continue
+			}
+
+			node.requires, err = s.requirements(contents, name)
+			node.computed = s.generation
+			if err != nil {
+				s.fail(node, err)
+				changed = true
+				continue
+			}
+
+			for _, req := range node.requires {
+				if _, ok := s.nodes[req]; !ok {
+					s.add(req)
+					changed = true
+				}
+			}
+		}
+	}
+
+	// Skipping a package can make its dependents skippable, so this also
+	// has to settle before anything gets started.
+	ready := []*buildNode{}
+	for changed := true; changed; {
+		changed = false
+		ready = ready[:0]
+		for _, name := range s.order {
+			node := s.nodes[name]
+			if node.State != StatePending {
+				continue
+			}
+
+			is_ready := true
+			for _, req := range node.requires {
+				dep := s.nodes[req]
+				if dep.State == StateFailed || (dep.State == StateSkipped && dep.Reason != reasonUpToDate) {
+					node.State = StateSkipped
+					node.Reason = "dependency failed: " + req
+					s.logger.Warnf("Skipping %s (%s)", name, node.Reason)
+					is_ready = false
+					changed = true
+					break
+				}
+				if dep.State != StateBuilt && dep.State != StateSkipped {
+					is_ready = false
+				}
+			}
+
+			if is_ready {
+				ready = append(ready, node)
+			}
+		}
+	}
+
+	for _, node := range ready {
+		slot := s.freeSlot(node.Name)
+		if slot < 0 || s.stopping {
+			break
+		}
+
+		s.start(node, slot, done)
+	}
+
+	return nil
+}
+
+// freeSlot picks a job slot for name, preferring one whose root holds
+// progress from an earlier attempt so the build can resume there.
+func (s *scheduler) freeSlot(name string) int {
+	rc := -1
+	fqn, hash, err := s.stageHash(name)
+
+	for idx, busy := range s.slots {
+		if busy {
+			continue
+		}
+		if rc < 0 {
+			rc = idx
+		}
+		if err != nil {
+			break
+		}
+
+		completed, err := CompletedStages(JobRoot(s.root, idx), fqn, hash)
+		if err == nil && len(completed) > 0 {
+			return idx
+		}
+	}
+	return rc
+}
+
+// stageHash returns the FQN and stage marker hash a build of name would use.
+func (s *scheduler) stageHash(name string) (string, string, error) {
+	pkg, err := s.loadSpec(name)
+	if err != nil {
+		return "", "", err
+	}
+	contents, err := s.pkgdb.Read()
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := stageHash(contents, *pkg)
+	return pkg.GetFQN(), hash, err
+}
+
+func (s *scheduler) start(node *buildNode, slot int, done chan buildDone) {
+	node.State = StateRunning
+	node.started = time.Now()
+	s.slots[slot] = true
+	s.running++
+
+	sel := StageSelection{Resume: s.opts.Stages.Resume}
+	if node.target {
+		sel = s.opts.Stages
+	}
+
+	root := JobRoot(s.root, slot)
+	s.logger.Infof("Starting: %s (job %d, %s)", node.Name, slot, root)
+
+	go func(name string) {
+		err := Build(s.pkgdb, root, name, sel)
+		done <- buildDone{name, slot, err}
+	}(node.Name)
+}
+
+func (s *scheduler) finish(result buildDone) {
+	node := s.nodes[result.name]
+	s.slots[result.slot] = false
+	s.running--
+	s.generation++
+	node.finished = time.Now()
+
+	if result.err != nil {
+		s.fail(node, result.err)
+		return
+	}
+
+	node.State = StateBuilt
+	s.logger.Infof("Built: %s", node.Name)
+
+	if node.target && s.opts.Stages.Until != "" {
+		// The package isn't necessarily complete, so there's nothing to
+		// install yet.
+		node.Reason = "until " + s.opts.Stages.Until
+		return
+	}
+
+	// Runtime dependencies aren't needed to build this package, but anyone
+	// installing it will want them.
+	contents, err := s.pkgdb.Read()
+	if err != nil {
+		s.fail(node, err)
+		return
+	}
+
+	pkg, err := s.loadSpec(node.Name)
+	if err != nil {
+		s.fail(node, err)
+		return
+	}
+
+	atoms := append([]string{}, pkg.Depends.Run...)
+	for _, sub := range pkg.Subpackages {
+		atoms = append(atoms, sub.Depends...)
+	}
+
+	for _, atom := range atoms {
+		fqn, err := contents.FindFQN(atom)
+		if err != nil {
+			s.fail(node, err)
+			return
+		}
+		dep := contents.Packages[*fqn]
+		if !dep.GeneratedValid {
+			s.add(dep.SpecName())
+		}
+	}
+}
+
+func (s *scheduler) fail(node *buildNode, err error) {
+	node.State = StateFailed
+	node.Err = err
+	node.Reason = err.Error()
+	s.logger.Errorf("Failed: %s: %s", node.Name, err)
+
+	if !s.opts.KeepGoing && !s.stopping {
+		s.logger.Warn("Waiting for running builds to finish (use --keep-going to continue past failures).")
+		s.stopping = true
+	}
+}
+
+// recordRun saves timing for everything this run attempted, so the critical
+// path can be worked out later.
+func (s *scheduler) recordRun(started time.Time, targets []string) {
+	run := db.RunStats{Started: started, Finished: time.Now(), Targets: targets}
+	for _, name := range s.order {
+		node := s.nodes[name]
+		if node.started.IsZero() {
+			continue
+		}
+		run.Packages = append(run.Packages, db.RunPackage{
+			Name:     name,
+			Started:  node.started,
+			Finished: node.finished,
+			Requires: node.requires,
+			Failed:   node.State == StateFailed,
+		})
+	}
+
+	if len(run.Packages) == 0 {
+		return
+	}
+
+	stats := s.pkgdb.Stats()
+	err := stats.RecordRun(run)
+	if err != nil {
+		s.logger.Warnf("Couldn't record build statistics: %s", err)
+	}
+}
@@ -0,0 +1,568 @@
+package plumbing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/sirupsen/logrus"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/spec"
+)
+
+// With snapshots turned on, packages aren't built in the target root.
+// Instead, every distinct set of installed packages gets a base root, built
+// once and kept read-only under <snapshot dir>/bases/<key>, and each package
+// is built in its own root under <snapshot dir>/roots/<fqn>: an overlayfs
+// mount of the base with a private upper layer, or a copy of the base where
+// overlayfs isn't available. A build root's base holds all the package's
+// build and test dependencies, since an overlay's base can't change partway
+// through. Build roots are thrown away once the package is built, and kept
+// around for resuming if it fails. Bases that haven't been
+// used in a while are pruned according to snapshot-keep and
+// snapshot-max-age.
+
+const (
+	SnapshotsOff     = "off"
+	SnapshotsOverlay = "overlay"
+	SnapshotsCopy    = "copy"
+	SnapshotsAuto    = "auto"
+)
+
+func init() {
+	conf.RegisterKey("", "snapshot-dir", conf.ConfigKey{
+		HelpText:   "Where to keep base root snapshots and build roots (defaults to <repo>/snapshots).",
+		TakesValue: true,
+		Default:    "",
+	})
+
+	conf.RegisterKey("", "snapshot-keep", conf.ConfigKey{
+		HelpText:   "Number of base snapshots to keep, most recently used first (0 for no limit).",
+		TakesValue: true,
+		Default:    "10",
+	})
+
+	conf.RegisterKey("", "snapshot-max-age", conf.ConfigKey{
+		HelpText:   "Remove base snapshots not used for this long (e.g. 720h). Empty to keep them.",
+		TakesValue: true,
+		Default:    "",
+	})
+}
+
+func SnapshotDir() string {
+	if conf.Get("snapshot-dir") != "" {
+		return conf.Get("snapshot-dir")
+	}
+	return filepath.Join(conf.Get("repo"), "snapshots")
+}
+
+// snapshotKey identifies the base root holding exactly pkgs.
+func snapshotKey(pkgs []spec.SpecDbData) (string, []string) {
+	fqns := []string{}
+	for _, pkg := range pkgs {
+		fqns = append(fqns, pkg.GetFQN())
+	}
+	sort.Strings(fqns)
+
+	sum := sha256.Sum256([]byte(strings.Join(fqns, "\n")))
+	return hex.EncodeToString(sum[:])[:16], fqns
+}
+
+// baseSnapshot returns the path of the base root with virtual/base-minimal
+// and deps installed, creating it if it doesn't exist yet. The base can't
+// be pruned until the returned lock is closed.
+func baseSnapshot(logger *logrus.Entry, pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, deps []spec.SpecDbData) (string, *flock.Flock, error) {
+	base, err := contents.FindFQN("virtual/base-minimal")
+	if err != nil {
+		return "", nil, err
+	}
+
+	outstanding := map[string]bool{*base: true}
+	for _, dep := range deps {
+		outstanding[dep.GetFQN()] = true
+	}
+	pkgs, _, err := contents.Resolve(logger, outstanding)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, fqns := snapshotKey(pkgs)
+	bases, err := snapshotBases()
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(bases, key)
+
+	// Parallel builds often want the same base; only one of them should
+	// create it.
+	lock := flock.New(path + ".lock")
+	err = lock.Lock()
+	if err != nil {
+		return "", nil, err
+	}
+	defer lock.Close()
+
+	_, err = os.Stat(path)
+	if err == nil {
+		logger.Infof("Using snapshot %s.", key)
+		err = protectSnapshot(path)
+		if err != nil {
+			logger.Debugf("Couldn't make snapshot %s read-only: %s", key, err)
+		}
+	} else if os.IsNotExist(err) {
+		err = createSnapshot(logger, pkgdb, contents, path, deps, fqns)
+		if err != nil {
+			return "", nil, err
+		}
+	} else {
+		return "", nil, err
+	}
+
+	// The list's modification time says when the base was last used.
+	now := time.Now()
+	err = os.Chtimes(path+".list", now, now)
+	if err != nil {
+		return "", nil, err
+	}
+
+	use := flock.New(path + ".use")
+	err = use.RLock()
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = pruneSnapshots(logger, bases)
+	if err != nil {
+		logger.Warnf("Couldn't prune snapshots: %s", err)
+	}
+
+	return path, use, nil
+}
+
+// snapshotBases returns the directory base snapshots are kept in, by its
+// real path, since that's how their mount points are listed.
+func snapshotBases() (string, error) {
+	bases, err := filepath.Abs(filepath.Join(SnapshotDir(), "bases"))
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(bases, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(bases)
+}
+
+func createSnapshot(logger *logrus.Entry, pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, path string, deps []spec.SpecDbData, fqns []string) error {
+	logger.Infof("Creating snapshot %s.", filepath.Base(path))
+	tmp := path + ".tmp"
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = reconcileRoot(logger, pkgdb, contents, tmp, deps)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".list", []byte(strings.Join(fqns, "\n")+"\n"), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	err = protectSnapshot(path)
+	if err != nil {
+		logger.Warnf("Couldn't make snapshot %s read-only: %s", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// protectSnapshot makes the base at path read-only by bind mounting it over
+// itself read-only. That only lasts until the next reboot, so it's redone
+// whenever the base is used.
+func protectSnapshot(path string) error {
+	mounted, read_only, err := mountState(path)
+	if err != nil || read_only {
+		return err
+	}
+	if !mounted {
+		out, err := exec.Command("mount", "--bind", path, path).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.TrimSpace(string(out)), err)
+		}
+	}
+	out, err := exec.Command("mount", "-o", "remount,bind,ro", path).CombinedOutput()
+	if err != nil {
+		exec.Command("umount", path).Run()
+		return fmt.Errorf("%s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// mountState reports whether something's mounted at path, and if so whether
+// the topmost mount is read-only.
+func mountState(path string) (bool, bool, error) {
+	raw, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, false, err
+	}
+
+	mounted, read_only := false, false
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || unescapeMountPath(fields[4]) != path {
+			continue
+		}
+		mounted = true
+		read_only = false
+		for _, option := range strings.Split(fields[5], ",") {
+			read_only = read_only || option == "ro"
+		}
+	}
+	return mounted, read_only, nil
+}
+
+// unescapeMountPath undoes the octal escapes (like \040 for a space) in
+// mountinfo paths.
+func unescapeMountPath(raw string) string {
+	return mountEscapeRegexp.ReplaceAllStringFunc(raw, func(escape string) string {
+		value, _ := strconv.ParseUint(escape[1:], 8, 8)
+		return string([]byte{byte(value)})
+	})
+}
+
+var mountEscapeRegexp = regexp.MustCompile(`\\[0-7]{3}`)
+
+// pruneSnapshots removes bases beyond snapshot-keep, most recently used
+// first, and ones not used within snapshot-max-age. Bases that are being
+// created or used are left alone.
+func pruneSnapshots(logger *logrus.Entry, bases string) error {
+	keep := conf.GetInt("snapshot-keep")
+
+	var max_age time.Duration
+	if conf.Get("snapshot-max-age") != "" {
+		var err error
+		max_age, err = time.ParseDuration(conf.Get("snapshot-max-age"))
+		if err != nil {
+			return fmt.Errorf("bad snapshot-max-age: %w", err)
+		}
+	}
+
+	ents, err := ioutil.ReadDir(bases)
+	if err != nil {
+		return err
+	}
+
+	type snapshot struct {
+		key  string
+		used time.Time
+	}
+	snapshots := []snapshot{}
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), ".list") {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{strings.TrimSuffix(ent.Name(), ".list"), ent.ModTime()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].used.After(snapshots[j].used) })
+
+	for idx, snap := range snapshots {
+		remove := keep > 0 && idx >= keep
+		if !remove && max_age > 0 {
+			remove = time.Since(snap.used) > max_age
+		}
+		if !remove {
+			continue
+		}
+
+		removed, err := removeSnapshot(filepath.Join(bases, snap.key))
+		if err != nil {
+			return err
+		}
+		if removed {
+			logger.Infof("Pruned snapshot %s.", snap.key)
+		}
+	}
+	return nil
+}
+
+// removeSnapshot removes the base at path, unless it's in use.
+func removeSnapshot(path string) (bool, error) {
+	lock := flock.New(path + ".lock")
+	locked, err := lock.TryLock()
+	if err != nil || !locked {
+		return false, err
+	}
+	defer lock.Close()
+
+	use := flock.New(path + ".use")
+	locked, err = use.TryLock()
+	if err != nil || !locked {
+		return false, err
+	}
+	defer use.Close()
+
+	for {
+		mounted, _, err := mountState(path)
+		if err != nil {
+			return false, err
+		}
+		if !mounted {
+			break
+		}
+		out, err := exec.Command("umount", path).CombinedOutput()
+		if err != nil {
+			return false, fmt.Errorf("unmounting %s: %s: %w", path, strings.TrimSpace(string(out)), err)
+		}
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Remove(path + ".list")
+}
+
+// buildRoot is the root a single package is built in when snapshots are on.
+type buildRoot struct {
+	Path string
+
+	logger  *logrus.Entry
+	mode    string
+	upper   string       // overlay upper and work directories live under here
+	base    *flock.Flock // keeps the mounted base from being pruned
+	mounted bool
+}
+
+func openBuildRoot(logger *logrus.Entry, fqn string, mode string) *buildRoot {
+	roots := filepath.Join(SnapshotDir(), "roots")
+	root := &buildRoot{
+		Path:   filepath.Join(roots, fqn),
+		logger: logger,
+		mode:   mode,
+		upper:  filepath.Join(roots, fqn+".upper"),
+	}
+
+	// Pick up whatever an earlier attempt left behind, so it can be resumed.
+	if _, err := os.Stat(root.upper); err == nil {
+		root.mode = SnapshotsOverlay
+	} else if _, err := os.Stat(root.Path); err == nil {
+		root.mode = SnapshotsCopy
+	}
+
+	// Something may still be mounted there if an earlier attempt was
+	// killed.
+	if root.mode != SnapshotsCopy {
+		exec.Command("umount", root.Path).Run()
+	}
+
+	return root
+}
+
+// reopenBuildRoot opens what an earlier attempt at building fqn left of its
+// build root, mounting an overlay on the base it was made on if it isn't
+// mounted already. It's nil if there's nothing left.
+func reopenBuildRoot(logger *logrus.Entry, fqn string) (*buildRoot, error) {
+	roots, err := filepath.Abs(filepath.Join(SnapshotDir(), "roots"))
+	if err != nil {
+		return nil, err
+	}
+	root := &buildRoot{
+		Path:   filepath.Join(roots, fqn),
+		logger: logger,
+		mode:   SnapshotsCopy,
+		upper:  filepath.Join(roots, fqn+".upper"),
+	}
+
+	if _, err := os.Stat(root.upper); err != nil {
+		if _, err := os.Stat(root.Path); err != nil {
+			return nil, nil
+		}
+		return root, nil
+	}
+	root.mode = SnapshotsOverlay
+
+	mounted, _, err := mountState(root.Path)
+	if err != nil || mounted {
+		// Something else (like a running build) is using it.
+		return root, err
+	}
+
+	key, err := ioutil.ReadFile(filepath.Join(root.upper, "base"))
+	if err != nil {
+		return nil, fmt.Errorf("build root %s doesn't say which snapshot it was made on", root.Path)
+	}
+	bases, err := snapshotBases()
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(bases, strings.TrimSpace(string(key)))
+	if _, err := os.Stat(base); err != nil {
+		return nil, fmt.Errorf("snapshot %s, which build root %s was made on, is gone", filepath.Base(base), root.Path)
+	}
+
+	use := flock.New(base + ".use")
+	err = use.RLock()
+	if err != nil {
+		return nil, err
+	}
+	_, err = root.mount(base)
+	if err != nil {
+		use.Close()
+		return nil, err
+	}
+	root.base = use
+	return root, nil
+}
+
+// Use makes the build root hold deps on top of base-minimal, keeping
+// anything an earlier attempt left in it. It reports whether the root
+// started out empty, with nothing to resume from. It's only called once per
+// build, since an overlay can't have its base swapped out from under it.
+func (root *buildRoot) Use(pkgdb db.PackageDatabase, contents *db.PackageDatabaseContents, deps []spec.SpecDbData) (bool, error) {
+	_, err := os.Stat(root.Path)
+	exists := err == nil
+
+	if root.mode == SnapshotsCopy && exists {
+		// A copy can be brought up to date by hand.
+		return false, reconcileRoot(root.logger, pkgdb, contents, root.Path, deps)
+	}
+
+	base, use, err := baseSnapshot(root.logger, pkgdb, contents, deps)
+	if err != nil {
+		return false, err
+	}
+
+	if root.mode != SnapshotsCopy {
+		fresh, err := root.mount(base)
+		if err == nil {
+			root.mode = SnapshotsOverlay
+			root.base = use
+			return fresh, nil
+		}
+		if root.mode == SnapshotsOverlay {
+			use.Close()
+			return false, err
+		}
+		root.logger.Warnf("Couldn't mount an overlay, copying the snapshot instead: %s", err)
+		os.RemoveAll(root.upper)
+		os.Remove(root.Path)
+		root.mode = SnapshotsCopy
+	}
+
+	// A copy doesn't need the base once it's made.
+	defer use.Close()
+
+	err = os.MkdirAll(filepath.Dir(root.Path), os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+	cmd := exec.Command("cp", "-a", "--reflink=auto", base, root.Path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		root.logger.Error(string(out))
+		return false, fmt.Errorf("copying snapshot: %w", err)
+	}
+	return true, nil
+}
+
+// mount mounts the build root as an overlay on base. overlayfs only supports
+// an upper layer on the lower layer it was made with, so the upper layer
+// records which base that was, and one made on another base is thrown away.
+// It reports whether the upper layer is new.
+func (root *buildRoot) mount(base string) (bool, error) {
+	err := root.unmount()
+	if err != nil {
+		return false, err
+	}
+
+	key := filepath.Base(base)
+	key_file := filepath.Join(root.upper, "base")
+	fresh := false
+	if made_on, err := ioutil.ReadFile(key_file); err != nil || strings.TrimSpace(string(made_on)) != key {
+		if _, err := os.Stat(root.upper); err == nil {
+			root.logger.Warnf("Build root wasn't made on snapshot %s; starting over.", key)
+		}
+		err = os.RemoveAll(root.upper)
+		if err != nil {
+			return false, err
+		}
+		fresh = true
+	}
+
+	upper := filepath.Join(root.upper, "upper")
+	work := filepath.Join(root.upper, "work")
+	for _, dir := range []string{upper, work, root.Path} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = ioutil.WriteFile(key_file, []byte(key+"\n"), os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+
+	cmd := exec.Command("mount", "-t", "overlay", "overlay",
+		"-o", "lowerdir="+base+",upperdir="+upper+",workdir="+work, root.Path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", strings.TrimSpace(string(out)), err)
+	}
+	root.mounted = true
+	return fresh, nil
+}
+
+func (root *buildRoot) unmount() error {
+	if !root.mounted {
+		return nil
+	}
+
+	cmd := exec.Command("umount", root.Path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unmounting %s: %s: %w", root.Path, strings.TrimSpace(string(out)), err)
+	}
+	root.mounted = false
+	if root.base != nil {
+		root.base.Close()
+		root.base = nil
+	}
+	return nil
+}
+
+// Close unmounts the build root, leaving its contents in place.
+func (root *buildRoot) Close() error {
+	return root.unmount()
+}
+
+// Discard removes the build root entirely.
+func (root *buildRoot) Discard() error {
+	err := root.unmount()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(root.upper)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(root.Path)
+}
@@ -0,0 +1,120 @@
+package plumbing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"m0rg.dev/x10/db"
+	"m0rg.dev/x10/spec"
+)
+
+// StageSelection picks which of a package's stages Build runs.
+type StageSelection struct {
+	From   string // first stage to run; empty to start from the beginning (or resume)
+	Until  string // last stage to run; empty to run to the end
+	Resume bool   // skip stages that completed in an earlier, failed build
+}
+
+func (sel StageSelection) IsPartial() bool {
+	return sel.From != "" || sel.Until != ""
+}
+
+func stageMarkerDir(root string, fqn string) string {
+	return filepath.Join(root, "var", "db", "x10", "stages", fqn)
+}
+
+// Each stage marker holds the build hash of the package it was made for, so
+// progress from a build of different inputs (an edited spec, layer or patch,
+// or other dependencies) isn't picked up.
+func stageHash(contents *db.PackageDatabaseContents, pkg spec.SpecLayer) (string, error) {
+	inputs, err := contents.BuildInputs(pkg)
+	if err != nil {
+		return "", err
+	}
+	return db.BuildHash(inputs), nil
+}
+
+// CompletedStages returns the stages of fqn that have completed in root
+// since its last full build, with the same build hash.
+func CompletedStages(root string, fqn string, hash string) (map[string]bool, error) {
+	rc := map[string]bool{}
+
+	ents, err := ioutil.ReadDir(stageMarkerDir(root, fqn))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rc, nil
+		}
+		return nil, err
+	}
+
+	for _, ent := range ents {
+		marker, err := ioutil.ReadFile(filepath.Join(stageMarkerDir(root, fqn), ent.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(marker)) == hash {
+			rc[ent.Name()] = true
+		}
+	}
+	return rc, nil
+}
+
+func MarkStageComplete(root string, fqn string, stage string, hash string) error {
+	dir := stageMarkerDir(root, fqn)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, stage), []byte(hash+"\n"), os.ModePerm)
+}
+
+func ClearStageMarkers(root string, fqn string) error {
+	return os.RemoveAll(stageMarkerDir(root, fqn))
+}
+
+// selectStages narrows order down to the stages sel asks for.
+func selectStages(order []string, completed map[string]bool, sel StageSelection) ([]string, error) {
+	index := func(stage string) (int, error) {
+		for idx, s := range order {
+			if s == stage {
+				return idx, nil
+			}
+		}
+		return -1, fmt.Errorf("no stage %s in stage order %v", stage, order)
+	}
+
+	first := 0
+	last := len(order) - 1
+
+	if sel.From != "" {
+		idx, err := index(sel.From)
+		if err != nil {
+			return nil, err
+		}
+		first = idx
+	} else if sel.Resume {
+		for first < len(order) && completed[order[first]] {
+			first++
+		}
+		if first == len(order) {
+			first = 0
+		}
+	}
+
+	if sel.Until != "" {
+		idx, err := index(sel.Until)
+		if err != nil {
+			return nil, err
+		}
+		last = idx
+	}
+
+	if last < first {
+		return nil, fmt.Errorf("stage %s comes before %s", order[last], order[first])
+	}
+
+	return order[first : last+1], nil
+}
@@ -1,6 +1,11 @@
 package plumbing
 
 import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"m0rg.dev/x10/conf"
 	"m0rg.dev/x10/db"
 	"m0rg.dev/x10/pkgset"
 )
@@ -28,3 +33,30 @@ func AddPackageToLocalWorld(pkgdb db.PackageDatabase, root string, atom string)
 func GetWorld(root string) (*pkgset.PackageSet, error) {
 	return pkgset.Set("world", root)
 }
+
+// AllPackages lists the name of every package spec in the packages directory.
+func AllPackages() ([]string, error) {
+	names := []string{}
+	pkgdir := conf.Get("packages")
+
+	err := filepath.WalkDir(pkgdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == "layers" ||
+			d.Name() == "files" ||
+			d.Name() == "etc") {
+			return fs.SkipDir
+		}
+		if d.Type().IsRegular() && strings.HasSuffix(path, ".yml") {
+			rel, err := filepath.Rel(pkgdir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, strings.TrimSuffix(rel, ".yml"))
+		}
+		return nil
+	})
+
+	return names, err
+}
@@ -0,0 +1,102 @@
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BwrapRunner uses bubblewrap to run inside the target root itself, so the
+// root has to be a complete system (no base image is layered underneath).
+// Needs bubblewrap 0.5 or later for --clearenv.
+// Memory and CPU limits need a systemd user session.
+type BwrapRunner struct{}
+
+func init() {
+	RegisterRunner(BwrapRunner{}, "bwrap")
+}
+
+func (BwrapRunner) args(root string, opts Options) ([]string, error) {
+	targetdir, err := prepareRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := targetMounts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"--bind", targetdir, "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--unshare-ipc", "--unshare-pid", "--unshare-uts",
+		"--die-with-parent",
+	}
+	for _, mount := range mounts {
+		switch {
+		case mount.IsTmpfs && mount.Size != "":
+			size, err := parseSize(mount.Size)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--size", strconv.FormatInt(size, 10), "--tmpfs", mount.Target)
+		case mount.IsTmpfs:
+			args = append(args, "--tmpfs", mount.Target)
+		case mount.ReadOnly:
+			args = append(args, "--ro-bind", mount.Source, mount.Target)
+		default:
+			args = append(args, "--bind", mount.Source, mount.Target)
+		}
+	}
+
+	if !opts.Network {
+		args = append(args, "--unshare-net")
+	}
+
+	args = append(args, "--clearenv")
+	for _, env := range stageEnv(opts) {
+		kv := strings.SplitN(env, "=", 2)
+		args = append(args, "--setenv", kv[0], kv[1])
+	}
+
+	return args, nil
+}
+
+func (r BwrapRunner) RunScript(logger *logrus.Entry, root string, script string, opts Options) error {
+	args, err := r.args(root, opts)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, "/usr/bin/bash", "-e", "-x")
+
+	prefix, err := systemdRunArgs(opts.Limits, true)
+	if err != nil {
+		return err
+	}
+	argv := append(append(prefix, "bwrap"), args...)
+
+	return runScript(logger, exec.Command(argv[0], argv[1:]...), script, opts)
+}
+
+func (r BwrapRunner) RunShell(logger *logrus.Entry, root string, setup_script string, opts Options) error {
+	rcfile, err := writeShellRc(setup_script)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rcfile)
+
+	opts.Mounts = append(opts.Mounts, Mount{rcfile, shellRcTarget, true})
+	args, err := r.args(root, opts)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, "/usr/bin/bash", "--rcfile", shellRcTarget, "-i")
+	return runInteractive(logger, exec.Command("bwrap", args...))
+}
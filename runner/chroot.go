@@ -0,0 +1,120 @@
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ChrootRunner chroots into the target root from inside fresh mount, PID,
+// IPC and UTS (and, unless asked otherwise, network) namespaces. Like bwrap,
+// the root has to be a complete system. Needs to run as root (or with
+// CAP_SYS_ADMIN and CAP_SYS_CHROOT). Memory and CPU limits go through
+// systemd-run.
+type ChrootRunner struct{}
+
+func init() {
+	RegisterRunner(ChrootRunner{}, "chroot")
+}
+
+// command builds an unshare invocation whose wrapper script sets up the
+// mounts and then execs argv in the chroot. Everything the wrapper mounts
+// goes away with the namespace.
+func (ChrootRunner) command(root string, opts Options, argv ...string) (*exec.Cmd, error) {
+	targetdir, err := prepareRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := targetMounts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := []string{
+		"set -e",
+		"mkdir -p " + ShellQuote(targetdir+"/dev") + " " + ShellQuote(targetdir+"/proc"),
+		"mount --rbind /dev " + ShellQuote(targetdir+"/dev"),
+		"mount -t proc proc " + ShellQuote(targetdir+"/proc"),
+	}
+
+	for _, mount := range mounts {
+		target := ShellQuote(targetdir + mount.Target)
+		if mount.IsTmpfs {
+			options := ""
+			if mount.Size != "" {
+				options = " -o size=" + ShellQuote(mount.Size)
+			}
+			wrapper = append(wrapper, "mkdir -p "+target, "mount -t tmpfs"+options+" tmpfs "+target)
+			continue
+		}
+
+		stat, err := os.Stat(mount.Source)
+		if err == nil && !stat.IsDir() {
+			wrapper = append(wrapper, "mkdir -p \"$(dirname "+target+")\"", "touch "+target)
+		} else {
+			wrapper = append(wrapper, "mkdir -p "+target)
+		}
+		wrapper = append(wrapper, "mount --bind "+ShellQuote(mount.Source)+" "+target)
+		if mount.ReadOnly {
+			wrapper = append(wrapper, "mount -o remount,bind,ro "+target)
+		}
+	}
+
+	quoted := []string{}
+	for _, arg := range argv {
+		quoted = append(quoted, ShellQuote(arg))
+	}
+	env := []string{}
+	for _, assignment := range stageEnv(opts) {
+		env = append(env, ShellQuote(assignment))
+	}
+	wrapper = append(wrapper, "exec env -i "+strings.Join(env, " ")+" chroot "+ShellQuote(targetdir)+" "+strings.Join(quoted, " "))
+
+	unshare_args := []string{"--mount", "--propagation", "private",
+		"--pid", "--fork", "--kill-child", "--ipc", "--uts"}
+	if !opts.Network {
+		unshare_args = append(unshare_args, "--net")
+	}
+	unshare_args = append(unshare_args, "/bin/sh", "-c", strings.Join(wrapper, "\n"))
+
+	prefix, err := systemdRunArgs(opts.Limits, false)
+	if err != nil {
+		return nil, err
+	}
+	command := append(append(prefix, "unshare"), unshare_args...)
+
+	// The host environment is still there for systemd-run and unshare; the
+	// wrapper leaves it behind.
+	return exec.Command(command[0], command[1:]...), nil
+}
+
+func (r ChrootRunner) RunScript(logger *logrus.Entry, root string, script string, opts Options) error {
+	cmd, err := r.command(root, opts, "/usr/bin/bash", "-e", "-x")
+	if err != nil {
+		return err
+	}
+	return runScript(logger, cmd, script, opts)
+}
+
+func (r ChrootRunner) RunShell(logger *logrus.Entry, root string, setup_script string, opts Options) error {
+	rcfile, err := writeShellRc(setup_script)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rcfile)
+
+	opts.Mounts = append(opts.Mounts, Mount{rcfile, shellRcTarget, true})
+	cmd, err := r.command(root, opts, "/usr/bin/bash", "--rcfile", shellRcTarget, "-i")
+	if err != nil {
+		return err
+	}
+	return runInteractive(logger, cmd)
+}
+
+// ShellQuote quotes s as one word for sh.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HostRunner runs scripts directly on the host with the target root as the
+// working directory. There's no isolation and paths like /destdir aren't
+// remapped, so this is only really useful for testing x10 itself. Mounts,
+// tmpfs, network, memory and CPU options are ignored; timeouts still apply.
+// Scripts see the whole host environment, not just what's passed through.
+type HostRunner struct{}
+
+func init() {
+	RegisterRunner(HostRunner{}, "host")
+}
+
+func (HostRunner) RunScript(logger *logrus.Entry, root string, script string, opts Options) error {
+	targetdir, err := prepareRoot(root)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/usr/bin/bash", "-e", "-x")
+	cmd.Dir = targetdir
+	cmd.Env = append(os.Environ(), opts.Env...)
+	return runScript(logger, cmd, script, opts)
+}
+
+func (HostRunner) RunShell(logger *logrus.Entry, root string, setup_script string, opts Options) error {
+	targetdir, err := prepareRoot(root)
+	if err != nil {
+		return err
+	}
+
+	rcfile, err := writeShellRc(setup_script)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rcfile)
+
+	cmd := exec.Command("/usr/bin/bash", "--rcfile", rcfile, "-i")
+	cmd.Dir = targetdir
+	cmd.Env = append(os.Environ(), opts.Env...)
+	return runInteractive(logger, cmd)
+}
@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/spec"
+)
+
+// Limits bounds the resources a script may use. Zero values mean unlimited.
+type Limits struct {
+	Timeout time.Duration
+	Memory  string // as understood by podman --memory, e.g. "4g"
+	CPUs    float64
+}
+
+// LimitError is returned when a script gets killed for exceeding one of its
+// limits, as opposed to failing on its own.
+type LimitError struct {
+	Limit string // "timeout" or "memory"
+	Value string
+	Err   error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("killed for exceeding %s limit (%s): %s", e.Limit, e.Value, e.Err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+func init() {
+	conf.RegisterKey("", "stage-timeout", conf.ConfigKey{
+		HelpText:   "Default time limit for stages (e.g. 2h). Empty for none.",
+		TakesValue: true,
+		Default:    "",
+	})
+
+	conf.RegisterKey("", "stage-memory", conf.ConfigKey{
+		HelpText:   "Default memory limit for stages (e.g. 4g). Empty for none.",
+		TakesValue: true,
+		Default:    "",
+	})
+
+	conf.RegisterKey("", "stage-cpus", conf.ConfigKey{
+		HelpText:   "Default CPU limit for stages (e.g. 4). Empty for none.",
+		TakesValue: true,
+		Default:    "",
+	})
+}
+
+// StageLimits works out the limits for a stage: its own settings where it
+// has them, and the configured defaults otherwise.
+func StageLimits(stage *spec.SpecStage) (Limits, error) {
+	limits := Limits{}
+
+	timeout := conf.Get("stage-timeout")
+	memory := conf.Get("stage-memory")
+	cpus := conf.Get("stage-cpus")
+
+	if stage != nil {
+		if stage.Timeout != nil {
+			timeout = *stage.Timeout
+		}
+		if stage.Memory != nil {
+			memory = *stage.Memory
+		}
+		if stage.CPUs != nil {
+			cpus = strconv.FormatFloat(*stage.CPUs, 'f', -1, 64)
+		}
+	}
+
+	if timeout != "" {
+		var err error
+		limits.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return Limits{}, fmt.Errorf("bad timeout %s: %w", timeout, err)
+		}
+	}
+
+	if memory != "" {
+		_, err := parseSize(memory)
+		if err != nil {
+			return Limits{}, err
+		}
+		limits.Memory = memory
+	}
+
+	if cpus != "" {
+		var err error
+		limits.CPUs, err = strconv.ParseFloat(cpus, 64)
+		if err != nil || limits.CPUs <= 0 {
+			return Limits{}, fmt.Errorf("bad CPU limit %s", cpus)
+		}
+	}
+
+	return limits, nil
+}
+
+// MakeJobs is how many parallel jobs a stage with these limits should use.
+func (limits Limits) MakeJobs(cpus int) int {
+	if limits.CPUs > 0 && limits.CPUs < float64(cpus) {
+		jobs := int(limits.CPUs + 0.5)
+		if jobs < 1 {
+			jobs = 1
+		}
+		return jobs
+	}
+	return cpus
+}
+
+// systemdRunArgs returns a command prefix that runs under a transient systemd
+// scope enforcing limits' memory and CPU settings, for backends that have no
+// way to do that themselves. Timeouts are handled in runScript.
+func systemdRunArgs(limits Limits, user bool) ([]string, error) {
+	if limits.Memory == "" && limits.CPUs == 0 {
+		return []string{}, nil
+	}
+
+	args := []string{"systemd-run", "--scope", "--quiet"}
+	if user {
+		args = append(args, "--user")
+	}
+
+	if limits.Memory != "" {
+		bytes, err := parseSize(limits.Memory)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-p", "MemoryMax="+strconv.FormatInt(bytes, 10), "-p", "MemorySwapMax=0")
+	}
+
+	if limits.CPUs > 0 {
+		args = append(args, "-p", fmt.Sprintf("CPUQuota=%d%%", int(limits.CPUs*100)))
+	}
+
+	return append(args, "--"), nil
+}
+
+// parseSize converts a mount-style size like "512m" into bytes.
+func parseSize(raw string) (int64, error) {
+	if raw == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	multiplier := int64(1)
+	switch strings.ToLower(raw[len(raw)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+
+	digits := raw
+	if multiplier != 1 {
+		digits = raw[:len(raw)-1]
+	}
+
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size %s: %w", raw, err)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,131 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/spec"
+)
+
+type Tmpfs struct {
+	Target string
+	Size   string // as understood by mount -o size=, e.g. "8g"; empty for the default
+}
+
+func init() {
+	conf.RegisterKey("", "runner-image", conf.ConfigKey{
+		HelpText:   "Container image the podman runner builds on.",
+		TakesValue: true,
+		Default:    "x10_base",
+	})
+
+	conf.RegisterKey("", "runner-mounts", conf.ConfigKey{
+		HelpText:   "Extra mounts for every stage, as comma-separated source:target[:ro].",
+		TakesValue: true,
+		Default:    "",
+	})
+
+	conf.RegisterKey("", "runner-tmpfs", conf.ConfigKey{
+		HelpText:   "tmpfs mounts for every stage, as comma-separated target[:size].",
+		TakesValue: true,
+		Default:    "",
+	})
+
+	conf.RegisterKey("", "runner-network", conf.ConfigKey{
+		HelpText:   "Deny network access even to stages that ask for it.",
+		TakesValue: false,
+		Default:    "true",
+	})
+
+	conf.RegisterKey("", "runner-pass-env", conf.ConfigKey{
+		HelpText:   "Comma-separated host environment variables to pass into stages.",
+		TakesValue: true,
+		Default:    "",
+	})
+}
+
+// NewOptions builds runner options from the global configuration, overlaid
+// with pkg's runner settings if pkg is given.
+func NewOptions(pkg *spec.SpecLayer) (Options, error) {
+	opts := Options{Image: conf.Get("runner-image")}
+
+	for _, raw := range splitList(conf.Get("runner-mounts")) {
+		parts := strings.Split(raw, ":")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro") {
+			return Options{}, fmt.Errorf("bad mount in runner-mounts: %s", raw)
+		}
+		source, err := filepath.Abs(parts[0])
+		if err != nil {
+			return Options{}, err
+		}
+		opts.Mounts = append(opts.Mounts, Mount{source, parts[1], len(parts) == 3})
+	}
+
+	for _, raw := range splitList(conf.Get("runner-tmpfs")) {
+		parts := strings.SplitN(raw, ":", 2)
+		tmpfs := Tmpfs{Target: parts[0]}
+		if len(parts) == 2 {
+			tmpfs.Size = parts[1]
+		}
+		opts.setTmpfs(tmpfs)
+	}
+
+	pass_env := splitList(conf.Get("runner-pass-env"))
+
+	if pkg != nil {
+		if pkg.Runner.Image != nil {
+			opts.Image = *pkg.Runner.Image
+		}
+
+		for _, mount := range pkg.Runner.Mounts {
+			source := mount.Source
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(conf.Get("packages"), source)
+			}
+			source, err := filepath.Abs(source)
+			if err != nil {
+				return Options{}, err
+			}
+			opts.Mounts = append(opts.Mounts, Mount{source, mount.Target, mount.ReadOnly})
+		}
+
+		for _, tmpfs := range pkg.Runner.Tmpfs {
+			opts.setTmpfs(Tmpfs{tmpfs.Target, tmpfs.Size})
+		}
+
+		pass_env = append(pass_env, pkg.Runner.PassEnv...)
+	}
+
+	for _, name := range pass_env {
+		value, ok := os.LookupEnv(name)
+		if ok {
+			opts.Env = append(opts.Env, name+"="+value)
+		}
+	}
+
+	return opts, nil
+}
+
+func (opts *Options) setTmpfs(tmpfs Tmpfs) {
+	for idx := range opts.Tmpfs {
+		if opts.Tmpfs[idx].Target == tmpfs.Target {
+			opts.Tmpfs[idx] = tmpfs
+			return
+		}
+	}
+	opts.Tmpfs = append(opts.Tmpfs, tmpfs)
+}
+
+func splitList(raw string) []string {
+	rc := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			rc = append(rc, item)
+		}
+	}
+	return rc
+}
@@ -0,0 +1,123 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"m0rg.dev/x10/conf"
+)
+
+// PodmanRunner runs everything in an x10_base container with the target
+// root's top-level directories mounted over the image's.
+type PodmanRunner struct{}
+
+func init() {
+	RegisterRunner(PodmanRunner{}, "podman")
+}
+
+func (PodmanRunner) args(root string, opts Options) ([]string, error) {
+	targetdir, err := prepareRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := targetMounts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	volume_args := []string{}
+	for _, mount := range mounts {
+		if mount.IsTmpfs {
+			spec := mount.Target
+			if mount.Size != "" {
+				spec += ":size=" + mount.Size
+			}
+			volume_args = append(volume_args, "--tmpfs", spec)
+			continue
+		}
+
+		spec := mount.Source + ":" + mount.Target
+		if mount.ReadOnly {
+			spec += ":ro"
+		}
+		volume_args = append(volume_args, "-v", spec)
+	}
+
+	if !opts.Network {
+		volume_args = append(volume_args, "--network=none")
+	}
+
+	if opts.Limits.Memory != "" {
+		volume_args = append(volume_args, "--memory="+opts.Limits.Memory, "--memory-swap="+opts.Limits.Memory)
+	}
+
+	if opts.Limits.CPUs > 0 {
+		volume_args = append(volume_args, "--cpus="+strconv.FormatFloat(opts.Limits.CPUs, 'f', -1, 64))
+	}
+
+	for _, env := range opts.Env {
+		volume_args = append(volume_args, "-e", env)
+	}
+
+	for _, dir := range []string{"bin", "etc", "lib", "lib64", "sbin", "tmp", "usr", "var", "builddir", "destdir"} {
+		if isMountTarget(mounts, "/"+dir) {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(targetdir, dir))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+		} else {
+			volume_args = append(volume_args, "-v")
+			volume_args = append(volume_args, fmt.Sprintf("%s/%s:/%s", targetdir, dir, dir))
+		}
+	}
+
+	return volume_args, nil
+}
+
+func (PodmanRunner) image(opts Options) string {
+	if opts.Image == "" {
+		return conf.Get("runner-image")
+	}
+	return opts.Image
+}
+
+func (r PodmanRunner) RunScript(logger *logrus.Entry, root string, script string, opts Options) error {
+	volume_args, err := r.args(root, opts)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"run", "--rm", "-i"}
+	args = append(args, volume_args...)
+	args = append(args, r.image(opts), "/usr/bin/bash", "-e", "-x")
+
+	return runScript(logger, exec.Command("podman", args...), script, opts)
+}
+
+func (r PodmanRunner) RunShell(logger *logrus.Entry, root string, setup_script string, opts Options) error {
+	rcfile, err := writeShellRc(setup_script)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rcfile)
+
+	opts.Mounts = append(opts.Mounts, Mount{rcfile, shellRcTarget, true})
+	volume_args, err := r.args(root, opts)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"run", "--rm", "-it"}
+	args = append(args, volume_args...)
+	args = append(args, r.image(opts), "/usr/bin/bash", "--rcfile", shellRcTarget, "-i")
+
+	return runInteractive(logger, exec.Command("podman", args...))
+}
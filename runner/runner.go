@@ -2,59 +2,270 @@ package runner
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/x10_log"
 )
 
-func RunTargetScript(logger *logrus.Entry, root string, script string, additional_podman_args []string) (err error) {
-	hostdir, err := filepath.Abs(conf.Get("repo"))
+// Mount is a host path made available inside the target environment.
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// Options holds per-invocation settings that every backend has to honour.
+// Use NewOptions to pick up the configured defaults.
+type Options struct {
+	Image  string  // only meaningful for backends that use images
+	Mounts []Mount // in addition to the standard ones
+	Tmpfs  []Tmpfs
+	Env    []string // NAME=value
+
+	// Network gives the script network access. Without it, backends that
+	// can isolate the network do.
+	Network bool
+
+	Limits Limits
+
+	// If set, combined stdout and stderr also go here, one Write per line.
+	Log io.Writer
+
+	// If set, filled in with the resources the script used.
+	Usage *Usage
+}
+
+// Usage is what a script cost to run. CPU covers the script's shell and
+// everything it waited for.
+type Usage struct {
+	Wall time.Duration
+	CPU  time.Duration
+}
+
+type Runner interface {
+	// RunScript feeds script to a non-interactive bash -e -x inside root.
+	RunScript(logger *logrus.Entry, root string, script string, opts Options) error
+	// RunShell starts an interactive bash inside root that has sourced
+	// setup_script first.
+	RunShell(logger *logrus.Entry, root string, setup_script string, opts Options) error
+}
+
+var runners = map[string]Runner{}
+
+func init() {
+	conf.RegisterKey("", "runner", conf.ConfigKey{
+		HelpText:   "Backend used to run stages and triggers: podman, bwrap, chroot or host.",
+		TakesValue: true,
+		Default:    "podman",
+	})
+}
+
+func RegisterRunner(r Runner, name string) {
+	runners[name] = r
+}
+
+// Get returns the configured runner backend.
+func Get() (Runner, error) {
+	r, ok := runners[conf.Get("runner")]
+	if !ok {
+		return nil, fmt.Errorf("unknown runner: %s", conf.Get("runner"))
+	}
+	return r, nil
+}
+
+func RunTargetScript(logger *logrus.Entry, root string, script string, opts Options) error {
+	r, err := Get()
 	if err != nil {
 		return err
 	}
+	return r.RunScript(logger, root, script, opts)
+}
 
-	pkgs, err := filepath.Abs(conf.Get("packages"))
+func RunTargetShell(logger *logrus.Entry, root string, setup_script string, opts Options) error {
+	r, err := Get()
 	if err != nil {
 		return err
 	}
+	return r.RunShell(logger, root, setup_script, opts)
+}
 
+// prepareRoot makes sure the directories every stage expects exist, and
+// returns the absolute path to root.
+func prepareRoot(root string) (string, error) {
 	targetdir, err := filepath.Abs(root)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	os.MkdirAll(hostdir, os.ModePerm)
 	os.MkdirAll(targetdir+"/destdir", os.ModePerm)
 	os.MkdirAll(targetdir+"/builddir", os.ModePerm)
+	return targetdir, nil
+}
 
-	volume_args := []string{}
-	for _, dir := range []string{"bin", "etc", "lib", "lib64", "sbin", "tmp", "usr", "var", "builddir", "destdir"} {
-		_, err := os.Stat(filepath.Join(targetdir, dir))
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return err
-			}
-		} else {
-			volume_args = append(volume_args, "-v")
-			volume_args = append(volume_args, fmt.Sprintf("%s/%s:/%s", targetdir, dir, dir))
+// stageEnv is the whole environment for backends that would otherwise pass
+// on x10's own: enough to find programs and a home directory, the terminal
+// type, and the variables opts passes through.
+func stageEnv(opts Options) []string {
+	env := []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/root",
+	}
+	if term, ok := os.LookupEnv("TERM"); ok {
+		env = append(env, "TERM="+term)
+	}
+	return append(env, opts.Env...)
+}
+
+// targetMount is something mounted into the target: Source bind mounted,
+// or a tmpfs of Size (if set) when IsTmpfs.
+type targetMount struct {
+	Mount
+	IsTmpfs bool
+	Size    string
+}
+
+// targetMounts lists what every backend mounts into the target: the binary
+// repository at /hostdir, the package tree's etc and files directories at
+// /etc/x10 and /pkgfiles, and then opts' mounts and tmpfs mounts. Each
+// target is only mounted once (the last one listed wins), and they're in
+// the order to mount them, so nothing ends up hidden under a later mount.
+// Whatever's here takes the place of the target root's own directory.
+func targetMounts(opts Options) ([]targetMount, error) {
+	hostdir, err := filepath.Abs(conf.Get("repo"))
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs, err := filepath.Abs(conf.Get("packages"))
+	if err != nil {
+		return nil, err
+	}
+
+	os.MkdirAll(hostdir, os.ModePerm)
+
+	all := []targetMount{
+		{Mount: Mount{hostdir, "/hostdir", false}},
+		{Mount: Mount{pkgs + "/etc", "/etc/x10", false}},
+		{Mount: Mount{pkgs + "/files", "/pkgfiles", false}},
+	}
+	for _, mount := range opts.Mounts {
+		all = append(all, targetMount{Mount: mount})
+	}
+	for _, tmpfs := range opts.Tmpfs {
+		all = append(all, targetMount{Mount: Mount{Target: tmpfs.Target}, IsTmpfs: true, Size: tmpfs.Size})
+	}
+
+	rc := []targetMount{}
+	for idx, mount := range all {
+		mount.Target = filepath.Clean(mount.Target)
+		replaced := false
+		for _, later := range all[idx+1:] {
+			replaced = replaced || filepath.Clean(later.Target) == mount.Target
+		}
+		if !replaced {
+			rc = append(rc, mount)
 		}
 	}
 
-	args := []string{"run", "--rm", "-i",
-		"-v", hostdir + ":/hostdir",
-		"-v", pkgs + "/etc:/etc/x10/",
-		"-v", pkgs + "/files:/pkgfiles",
+	sort.SliceStable(rc, func(i, j int) bool {
+		return strings.Count(rc[i].Target, "/") < strings.Count(rc[j].Target, "/")
+	})
+	return rc, nil
+}
+
+// isMountTarget reports whether something in mounts is mounted at target.
+func isMountTarget(mounts []targetMount, target string) bool {
+	for _, mount := range mounts {
+		if mount.Target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// writeShellRc puts setup_script somewhere it can be mounted into the target
+// as an rcfile. The caller should remove it when done.
+func writeShellRc(setup_script string) (string, error) {
+	rcfile, err := ioutil.TempFile("", "x10-shell-rc")
+	if err != nil {
+		return "", err
 	}
-	args = append(args, volume_args...)
-	args = append(args, additional_podman_args...)
-	args = append(args, "x10_base", "/usr/bin/bash", "-e", "-x")
-	logger.Debug(args)
-	cmd := exec.Command("podman", args...)
+	defer rcfile.Close()
+
+	_, err = rcfile.WriteString(setup_script + "\n")
+	if err != nil {
+		os.Remove(rcfile.Name())
+		return "", err
+	}
+	return rcfile.Name(), nil
+}
+
+const shellRcTarget = "/x10-shell-rc"
+
+// Scripts report their CPU time as they exit, as a timesMarker line followed
+// by the two lines of output from bash's times builtin. The script itself
+// runs in an inner bash, and the outer one calls times once it's exited, so
+// nothing the script does (like setting its own EXIT trap) gets in the way.
+// Measuring from inside the target works the same for every backend,
+// including ones where the script isn't our descendant; if the marker never
+// turns up, the CPU time of the process we started is used instead.
+const timesMarker = "@@x10-times@@"
+
+const scriptEnd = "@@x10-script-end@@"
+
+func wrapScript(script string) string {
+	return strings.Join([]string{
+		"{ set +x +e; } 2>/dev/null",
+		"/usr/bin/bash -e -x <<'" + scriptEnd + "'",
+		script,
+		scriptEnd,
+		"{ x10_status=$?; echo " + timesMarker + "; times; exit $x10_status; } >&2 2>/dev/null",
+	}, "\n") + "\n"
+}
+
+var timesRegexp = regexp.MustCompile(`(\d+)m([\d.]+)s`)
+
+func parseTimes(line string) time.Duration {
+	total := time.Duration(0)
+	for _, match := range timesRegexp.FindAllStringSubmatch(line, -1) {
+		minutes, _ := strconv.Atoi(match[1])
+		seconds, _ := strconv.ParseFloat(match[2], 64)
+		total += time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+	}
+	return total
+}
+
+type outputLine struct {
+	stream string
+	text   string
+}
+
+// How long a timed-out script gets between SIGTERM and SIGKILL.
+const killGrace = 30 * time.Second
+
+// runScript feeds script to cmd's stdin and collects its output, dumping it
+// if the command fails. If the script runs past opts.Limits.Timeout it's
+// stopped, and the error will be a *LimitError.
+func runScript(logger *logrus.Entry, cmd *exec.Cmd, script string, opts Options) error {
+	limits := opts.Limits
+
+	logger.Debug(cmd.Args)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -68,48 +279,163 @@ func RunTargetScript(logger *logrus.Entry, root string, script string, additiona
 	if err != nil {
 		return err
 	}
-	cmd.Start()
+	if limits.Timeout > 0 {
+		// Own process group, so a timeout can stop everything the script
+		// started.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
 
-	stdout_lines := []string{}
-	stderr_lines := []string{}
+	// Both streams land in one list (and one log), in the order they
+	// arrive.
+	var output_lock sync.Mutex
+	output := []outputLine{}
 
+	var timed int32
 	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
+	collect := func(stream string, reader io.Reader) {
 		defer wg.Done()
-		scanner := bufio.NewScanner(stdout)
+		scanner := bufio.NewScanner(reader)
+		times_lines := 0
 		for scanner.Scan() {
-			logger.Debug("[stdout] " + scanner.Text())
-			stdout_lines = append(stdout_lines, scanner.Text())
+			if scanner.Text() == timesMarker {
+				atomic.StoreInt32(&timed, 1)
+				times_lines = 2
+				continue
+			}
+			if times_lines > 0 {
+				times_lines--
+				if opts.Usage != nil {
+					opts.Usage.CPU += parseTimes(scanner.Text())
+				}
+				continue
+			}
+			logger.Debug("[" + stream + "] " + scanner.Text())
+
+			output_lock.Lock()
+			output = append(output, outputLine{stream, scanner.Text()})
+			if opts.Log != nil {
+				fmt.Fprintln(opts.Log, scanner.Text())
+			}
+			output_lock.Unlock()
 		}
-	}()
+	}
 
-	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			logger.Debug("[stderr] " + scanner.Text())
-			stderr_lines = append(stderr_lines, scanner.Text())
+	wg.Add(2)
+	go collect("stdout", stdout)
+	go collect("stderr", stderr)
+
+	// Once cmd has been waited for, its PID (and so the process group) may
+	// belong to something else, so the timers mustn't signal it any more.
+	var timed_out int32
+	var kill_lock sync.Mutex
+	waited := false
+	stopTimers := func() {}
+	if limits.Timeout > 0 {
+		pgid := cmd.Process.Pid
+		var grace *time.Timer
+		timer := time.AfterFunc(limits.Timeout, func() {
+			kill_lock.Lock()
+			defer kill_lock.Unlock()
+			if waited {
+				return
+			}
+
+			atomic.StoreInt32(&timed_out, 1)
+			logger.Errorf("Still running after %s; stopping.", limits.Timeout)
+			syscall.Kill(-pgid, syscall.SIGTERM)
+			grace = time.AfterFunc(killGrace, func() {
+				kill_lock.Lock()
+				defer kill_lock.Unlock()
+				if waited {
+					return
+				}
+
+				syscall.Kill(-pgid, syscall.SIGKILL)
+				// Anything still holding the output open has left the
+				// process group (e.g. with setsid), so stop reading.
+				stdout.Close()
+				stderr.Close()
+			})
+		})
+		stopTimers = func() {
+			kill_lock.Lock()
+			defer kill_lock.Unlock()
+			waited = true
+			timer.Stop()
+			if grace != nil {
+				grace.Stop()
+			}
 		}
-	}()
+	}
 
-	stdin.Write([]byte(script + "\n"))
+	started := time.Now()
+	stdin.Write([]byte(wrapScript(script)))
 	stdin.Close()
-	err = cmd.Wait()
 	wg.Wait()
+	err = cmd.Wait()
+	stopTimers()
+
+	if opts.Usage != nil {
+		opts.Usage.Wall = time.Since(started)
+		if atomic.LoadInt32(&timed) == 0 && cmd.ProcessState != nil {
+			logger.Warn("Script didn't report its CPU time; counting the runner's instead.")
+			if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+				opts.Usage.CPU += time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+			}
+		}
+	}
 
 	if err != nil {
-		logger.Error("Stage failed.")
-		logger.Error("Failing stage stdout output is:")
-		for _, line := range stdout_lines {
-			logger.Error("  " + line)
+		if atomic.LoadInt32(&timed_out) != 0 {
+			err = &LimitError{"timeout", limits.Timeout.String(), err}
+		} else if limits.Memory != "" && killedBySignal(err) {
+			err = &LimitError{"memory", limits.Memory, err}
 		}
-		logger.Error("Failing stage stderr output is:")
-		for _, line := range stderr_lines {
-			logger.Error("  " + line)
+
+		logger.Error("Stage failed.")
+		for _, stream := range []string{"stdout", "stderr"} {
+			logger.Errorf("Failing stage %s output is:", stream)
+			for _, line := range output {
+				// Skip x10's own markers, like the ones stage steps
+				// leave in the log.
+				if line.stream == stream && !strings.HasPrefix(line.text, "@@x10-") {
+					logger.Error("  " + line.text)
+				}
+			}
 		}
 		return err
 	}
 
-	return err
+	return nil
+}
+
+// killedBySignal tells whether err looks like the process was SIGKILLed, which
+// is what the OOM killer does. Containers report that as exit status 137.
+func killedBySignal(err error) bool {
+	var exit_err *exec.ExitError
+	if !errors.As(err, &exit_err) {
+		return false
+	}
+	if status, ok := exit_err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal() == syscall.SIGKILL
+	}
+	return exit_err.ExitCode() == 137
+}
+
+// runInteractive hands the terminal over to cmd.
+func runInteractive(logger *logrus.Entry, cmd *exec.Cmd) error {
+	logger.Debug(cmd.Args)
+
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	logger.Info("Starting shell; exit to continue.")
+	resume := x10_log.SuspendStatus()
+	defer resume()
+	return cmd.Run()
 }
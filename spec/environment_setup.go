@@ -3,16 +3,48 @@ package spec
 import (
 	"fmt"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+
+	"gopkg.in/yaml.v2"
+	"m0rg.dev/x10/conf"
 )
 
-func (pkg SpecLayer) GetEnvironmentSetupScript() string {
-	arrays := make(map[string][]string)
-	vars := make(map[string]string)
+// GetEnvironmentSetupScript exports the package's variables for a stage
+// script. The order is fixed: system variables, package metadata, arrays,
+// then the package's environment in layer order. Values are double-quoted,
+// so each one can refer to anything exported before it. make_jobs is what
+// X10_MAKE_JOBS is set to.
+func (pkg SpecLayer) GetEnvironmentSetupScript(make_jobs int) string {
+	lines := []string{}
+	export := func(name string, value string) {
+		lines = append(lines, fmt.Sprintf("export %s=%s", name, strconv.Quote(value)))
+	}
+
+	// System setup.
+	export("X10_MAKE_JOBS", strconv.Itoa(make_jobs))
+	export("DESTDIR", filepath.Join("/destdir", pkg.GetFQN()))
+	export("X10_PACKAGE_FQN", pkg.GetFQN())
+	export("X10_ARCH", conf.Get("arch"))
+
+	// Package metadata.
+	export("X10_META_NAME", pkg.Meta.Name)
+	export("X10_META_VERSION", pkg.Meta.Version)
+	export("X10_META_REVISION", strconv.Itoa(pkg.Meta.Revision))
+	export("X10_META_MAINTAINER", pkg.Meta.Maintainer)
+	export("X10_META_HOMEPAGE", pkg.Meta.Homepage)
+	export("X10_META_LICENSE", pkg.Meta.License)
+	export("X10_META_DESCRIPTION", pkg.Meta.Description)
+	if pkg.Meta.UnpackDir == nil {
+		export("X10_META_UNPACK_DIR", pkg.Meta.Name)
+	} else {
+		export("X10_META_UNPACK_DIR", *pkg.Meta.UnpackDir)
+	}
+	export("X10_WORKDIR", pkg.Workdir)
 
 	// Arrays from the package.
+	arrays := make(map[string][]string)
 	for _, source := range pkg.Sources {
 		arrays["X10_SOURCES_URLS"] = append(arrays["X10_SOURCES_URLS"], source.URL)
 		arrays["X10_SOURCES_CHECKSUMS"] = append(arrays["X10_SOURCES_CHECKSUMS"], source.Checksum)
@@ -22,49 +54,107 @@ func (pkg SpecLayer) GetEnvironmentSetupScript() string {
 	arrays["X10_DEPENDS_TESTS"] = pkg.Depends.Test
 	arrays["X10_DEPENDS_RUNS"] = pkg.Depends.Run
 	if pkg.Patches != nil {
-		arrays["X10_PATCHES"] = *pkg.Patches
+		arrays["X10_PATCHES"] = []string{}
+		for _, patch := range *pkg.Patches {
+			arrays["X10_PATCHES"] = append(arrays["X10_PATCHES"], patch.File)
+		}
 	}
+	arrays["X10_OPTIONS"] = pkg.EnabledOptions()
 
-	// Package metadata.
-	vars["X10_META_NAME"] = pkg.Meta.Name
-	vars["X10_META_VERSION"] = pkg.Meta.Version
-	vars["X10_META_REVISION"] = strconv.Itoa(pkg.Meta.Revision)
-	vars["X10_META_MAINTAINER"] = pkg.Meta.Maintainer
-	vars["X10_META_HOMEPAGE"] = pkg.Meta.Homepage
-	vars["X10_META_LICENSE"] = pkg.Meta.License
-	vars["X10_META_DESCRIPTION"] = pkg.Meta.Description
-	if pkg.Meta.UnpackDir == nil {
-		vars["X10_META_UNPACK_DIR"] = pkg.Meta.Name
-	} else {
-		vars["X10_META_UNPACK_DIR"] = *pkg.Meta.UnpackDir
+	array_names := []string{}
+	for name := range arrays {
+		array_names = append(array_names, name)
 	}
-	vars["X10_PACKAGE_FQN"] = pkg.GetFQN()
+	sort.Strings(array_names)
 
-	// System setup.
-	vars["X10_MAKE_JOBS"] = strconv.Itoa(runtime.NumCPU())
-	vars["DESTDIR"] = filepath.Join("/destdir", pkg.GetFQN())
+	for _, name := range array_names {
+		arr_quoted := []string{}
+		for _, val := range arrays[name] {
+			arr_quoted = append(arr_quoted, strconv.Quote(val))
+		}
+		lines = append(lines, fmt.Sprintf("export %s=(%s)", name, strings.Join(arr_quoted, " ")))
+	}
 
-	// Custom environment.
-	for name, value := range pkg.Environment {
-		vars[name] = value
+	// Custom environment, one layer at a time, so later layers can build on
+	// earlier ones (e.g. CFLAGS: "$CFLAGS -g").
+	last := map[string]string{}
+	for _, entry := range pkg.environmentEntries() {
+		export(entry.Name, entry.Value)
+		last[entry.Name] = entry.Value
 	}
 
-	lines := []string{}
+	// Anything set on the composite without going through a layer.
+	for _, name := range sortedEnvironmentNames(pkg.Environment) {
+		if value, ok := last[name]; !ok || value != pkg.Environment[name] {
+			export(name, pkg.Environment[name])
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
 
-	for name, val := range vars {
-		lines = append(lines, fmt.Sprintf("export %s=%s", name, strconv.Quote(val)))
+// environmentEntries is pkg.EnvironmentEntries, or its environment by name if
+// it wasn't loaded from a file.
+func (pkg SpecLayer) environmentEntries() []SpecEnvironmentEntry {
+	if len(pkg.EnvironmentEntries) > 0 || len(pkg.Environment) == 0 {
+		return pkg.EnvironmentEntries
 	}
+	return entriesInOrder(pkg.Environment, sortedEnvironmentNames(pkg.Environment))
+}
 
-	// TODO do this for everything so we have a set order
-	lines = append(lines, "export X10_WORKDIR="+strconv.Quote(pkg.Workdir))
+// readEnvironmentOrder records the order environment entries are declared
+// in, which maps don't keep.
+func (pkg *SpecLayer) readEnvironmentOrder(raw []byte) error {
+	order := struct {
+		Package struct {
+			Environment yaml.MapSlice
+			Options     []struct {
+				Name        string
+				Environment yaml.MapSlice
+			}
+		}
+	}{}
 
-	for name, arr := range arrays {
-		arr_quoted := []string{}
-		for _, val := range arr {
-			arr_quoted = append(arr_quoted, strconv.Quote(val))
+	err := yaml.Unmarshal(raw, &order)
+	if err != nil {
+		return err
+	}
+
+	pkg.EnvironmentEntries = entriesInOrder(pkg.Environment, mapSliceKeys(order.Package.Environment))
+	for _, declared := range order.Package.Options {
+		for idx := range pkg.Options {
+			if pkg.Options[idx].Name == declared.Name {
+				option := &pkg.Options[idx]
+				option.EnvironmentEntries = entriesInOrder(option.Environment, mapSliceKeys(declared.Environment))
+			}
 		}
-		lines = append(lines, fmt.Sprintf("export %s=(%s)", name, strings.Join(arr_quoted, " ")))
 	}
+	return nil
+}
 
-	return strings.Join(lines, "\n")
+func entriesInOrder(environment map[string]string, names []string) []SpecEnvironmentEntry {
+	rc := []SpecEnvironmentEntry{}
+	for _, name := range names {
+		if value, ok := environment[name]; ok {
+			rc = append(rc, SpecEnvironmentEntry{Name: name, Value: value})
+		}
+	}
+	return rc
+}
+
+func sortedEnvironmentNames(environment map[string]string) []string {
+	rc := []string{}
+	for name := range environment {
+		rc = append(rc, name)
+	}
+	sort.Strings(rc)
+	return rc
+}
+
+func mapSliceKeys(slice yaml.MapSlice) []string {
+	rc := []string{}
+	for _, item := range slice {
+		rc = append(rc, fmt.Sprint(item.Key))
+	}
+	return rc
 }
@@ -0,0 +1,175 @@
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// References look like ${meta.version}, ${env.CONFIGURE_ARGS} or
+// ${option.ssl}. Anything else (like a plain ${FOO}) is left for the shell,
+// and $${...} escapes a reference.
+var interpolateRegexp = regexp.MustCompile(`\$?\$\{(meta|env|option)\.([A-Za-z0-9_]+)\}`)
+
+type interpolator struct {
+	pkg       *SpecLayer
+	env       map[string]string
+	resolving map[string]bool
+	err       error
+}
+
+// interpolate resolves references in source URLs, the workdir, the unpack
+// directory, environment values and dependency atoms, so everything after
+// LoadPackage sees final values.
+func (pkg *SpecLayer) interpolate() error {
+	i := &interpolator{
+		pkg:       pkg,
+		env:       map[string]string{},
+		resolving: map[string]bool{},
+	}
+
+	// Environment entries can refer to each other, so resolve them all
+	// first, in a set order so errors are consistent.
+	names := []string{}
+	for name := range pkg.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		i.lookupEnv(name)
+	}
+	for name, value := range i.env {
+		pkg.Environment[name] = value
+	}
+	entries := make([]SpecEnvironmentEntry, len(pkg.EnvironmentEntries))
+	for idx, entry := range pkg.EnvironmentEntries {
+		entries[idx] = SpecEnvironmentEntry{Name: entry.Name, Value: i.expand(entry.Value)}
+	}
+	pkg.EnvironmentEntries = entries
+
+	for idx := range pkg.Sources {
+		pkg.Sources[idx].URL = i.expand(pkg.Sources[idx].URL)
+	}
+	pkg.Workdir = i.expand(pkg.Workdir)
+	if pkg.Meta != nil && pkg.Meta.UnpackDir != nil {
+		unpack_dir := i.expand(*pkg.Meta.UnpackDir)
+		meta := *pkg.Meta
+		meta.UnpackDir = &unpack_dir
+		pkg.Meta = &meta
+	}
+
+	i.expandAll(pkg.Depends.HostBuild)
+	i.expandAll(pkg.Depends.Build)
+	i.expandAll(pkg.Depends.Test)
+	i.expandAll(pkg.Depends.Run)
+	for idx := range pkg.Subpackages {
+		pkg.Subpackages[idx].Depends = append([]string{}, pkg.Subpackages[idx].Depends...)
+		i.expandAll(pkg.Subpackages[idx].Depends)
+	}
+
+	return i.err
+}
+
+// Interpolate resolves references in value against pkg, which should be a
+// composited package from LoadPackage. It's for values read from spec files
+// directly.
+func (pkg SpecLayer) Interpolate(value string) (string, error) {
+	i := &interpolator{
+		pkg:       &pkg,
+		env:       pkg.Environment,
+		resolving: map[string]bool{},
+	}
+	rc := i.expand(value)
+	return rc, i.err
+}
+
+func (i *interpolator) expandAll(values []string) {
+	for idx := range values {
+		values[idx] = i.expand(values[idx])
+	}
+}
+
+func (i *interpolator) expand(value string) string {
+	return interpolateRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref[1] == '$' {
+			return ref[1:]
+		}
+		match := interpolateRegexp.FindStringSubmatch(ref)
+		return i.lookup(match[1], match[2])
+	})
+}
+
+func (i *interpolator) lookup(namespace string, key string) string {
+	switch namespace {
+	case "meta":
+		return i.lookupMeta(key)
+	case "env":
+		return i.lookupEnv(key)
+	case "option":
+		on, ok := i.pkg.Chosen[key]
+		if !ok {
+			i.fail(fmt.Errorf("${option.%s}: no such option", key))
+			return ""
+		}
+		return strconv.FormatBool(on)
+	}
+	return ""
+}
+
+func (i *interpolator) lookupMeta(key string) string {
+	meta := i.pkg.Meta
+	if meta == nil {
+		i.fail(fmt.Errorf("${meta.%s}: package has no meta", key))
+		return ""
+	}
+
+	switch key {
+	case "name":
+		return meta.Name
+	case "version":
+		return meta.Version
+	case "revision":
+		return strconv.Itoa(meta.Revision)
+	case "maintainer":
+		return meta.Maintainer
+	case "homepage":
+		return meta.Homepage
+	case "license":
+		return meta.License
+	case "description":
+		return meta.Description
+	}
+	i.fail(fmt.Errorf("${meta.%s}: no such field", key))
+	return ""
+}
+
+func (i *interpolator) lookupEnv(name string) string {
+	if value, ok := i.env[name]; ok {
+		return value
+	}
+
+	raw, ok := i.pkg.Environment[name]
+	if !ok {
+		i.fail(fmt.Errorf("${env.%s}: no such environment entry", name))
+		return ""
+	}
+	if i.resolving[name] {
+		i.fail(fmt.Errorf("${env.%s} is circular", name))
+		return ""
+	}
+
+	i.resolving[name] = true
+	value := i.expand(raw)
+	delete(i.resolving, name)
+
+	i.env[name] = value
+	return value
+}
+
+// fail records the first error; later ones are usually knock-on effects.
+func (i *interpolator) fail(err error) {
+	if i.err == nil {
+		i.err = err
+	}
+}
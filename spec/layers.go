@@ -0,0 +1,310 @@
+package spec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"m0rg.dev/x10/conf"
+	"m0rg.dev/x10/x10_log"
+)
+
+// SpecLayerRef names a layer a spec builds on. In a spec it's one of
+//
+//   - cmake                              just the name
+//   - cmake: {build_type: Release}       the name and parameters
+//   - name: docs                         the full form, which can also
+//     params: {format: html}             have conditions, all of which
+//     when: [option.docs, arch=x86_64]   have to hold
+//
+// Conditions are option.NAME (or option.NAME=false) and arch=ARCH (or
+// arch!=ARCH).
+type SpecLayerRef struct {
+	Name   string
+	Params map[string]string `yaml:",omitempty"`
+	When   []string          `yaml:",omitempty"`
+}
+
+func (ref *SpecLayerRef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if unmarshal(&name) == nil {
+		ref.Name = name
+		return nil
+	}
+
+	var short map[string]map[string]string
+	if unmarshal(&short) == nil && len(short) == 1 {
+		for name, params := range short {
+			ref.Name = name
+			ref.Params = params
+		}
+		return nil
+	}
+
+	type plain SpecLayerRef
+	return unmarshal((*plain)(ref))
+}
+
+func (ref SpecLayerRef) MarshalYAML() (interface{}, error) {
+	if len(ref.When) > 0 {
+		type plain SpecLayerRef
+		return plain(ref), nil
+	}
+	if len(ref.Params) > 0 {
+		return map[string]map[string]string{ref.Name: ref.Params}, nil
+	}
+	return ref.Name, nil
+}
+
+// key identifies a use of a layer. A layer that several others need is only
+// applied once, unless they give it different parameters.
+func (ref SpecLayerRef) key() string {
+	params := []string{}
+	for name, value := range ref.Params {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+	return ref.Name + "{" + strings.Join(params, ",") + "}"
+}
+
+func init() {
+	conf.RegisterKey("", "arch", conf.ConfigKey{
+		HelpText:   "Architecture to build for, as seen by layer conditions and X10_ARCH.",
+		TakesValue: true,
+		Default:    hostArch(),
+	})
+}
+
+// hostArch names the host's architecture the way uname -m does.
+func hostArch() string {
+	names := map[string]string{
+		"386":   "i686",
+		"amd64": "x86_64",
+		"arm":   "armv7l",
+		"arm64": "aarch64",
+	}
+	if name, ok := names[runtime.GOARCH]; ok {
+		return name
+	}
+	return runtime.GOARCH
+}
+
+func layerPath(name string) string {
+	return filepath.Join(conf.Get("packages"), "layers", name+".yml")
+}
+
+type loadedFile struct {
+	path  string
+	layer SpecLayer
+}
+
+// layerLoader flattens a spec and the layers it (transitively) uses into
+// the list of files to composite, dependencies first.
+type layerLoader struct {
+	chosen  map[string]bool // nil to leave out every conditional layer
+	skipped bool            // whether any conditional layers were left out
+	seen    map[string]bool
+	files   []loadedFile
+}
+
+func (loader *layerLoader) load(path string, params map[string]string, chain []string) error {
+	logger := x10_log.Get("load").WithField("pkgsrc", path)
+	logger.Debug("Loading package")
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	pkg := Spec{}
+	err = yaml.UnmarshalStrict(raw, &pkg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if pkg.Package == nil {
+		return fmt.Errorf("%s: no package object?", path)
+	}
+
+	err = substituteParams(&pkg, params)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if loader.seen == nil {
+		loader.seen = map[string]bool{}
+	}
+
+	for _, ref := range pkg.Layers {
+		applies, err := loader.applies(ref)
+		if err != nil {
+			return fmt.Errorf("%s: layer %s: %w", path, ref.Name, err)
+		}
+		if !applies {
+			continue
+		}
+
+		layer_path := layerPath(ref.Name)
+		for idx, used := range chain {
+			if used == layer_path {
+				return fmt.Errorf("layer cycle: %s", strings.Join(append(chain[idx:], layer_path), " -> "))
+			}
+		}
+		if loader.seen[ref.key()] {
+			continue
+		}
+
+		logger.Debug("Loading layer: ", ref.Name)
+		loader.seen[ref.key()] = true
+		err = loader.load(layer_path, ref.Params, append(append([]string{}, chain...), layer_path))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pkg.Package.readEnvironmentOrder(raw)
+	if err != nil {
+		return err
+	}
+	pkg.Package.Files = []string{path}
+
+	loader.files = append(loader.files, loadedFile{path, *pkg.Package})
+	return nil
+}
+
+func (loader *layerLoader) applies(ref SpecLayerRef) (bool, error) {
+	if len(ref.When) > 0 && loader.chosen == nil {
+		loader.skipped = true
+		return false, nil
+	}
+
+	for _, cond := range ref.When {
+		holds, err := loader.holds(cond)
+		if err != nil || !holds {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (loader *layerLoader) holds(cond string) (bool, error) {
+	subject, want, negate := cond, "true", false
+	if idx := strings.Index(cond, "!="); idx >= 0 {
+		subject, want, negate = cond[:idx], cond[idx+2:], true
+	} else if idx := strings.Index(cond, "="); idx >= 0 {
+		subject, want = cond[:idx], cond[idx+1:]
+	}
+
+	value := ""
+	switch {
+	case subject == "arch":
+		value = conf.Get("arch")
+	case strings.HasPrefix(subject, "option."):
+		on, ok := loader.chosen[strings.TrimPrefix(subject, "option.")]
+		if !ok {
+			return false, fmt.Errorf("condition %s: no such option", cond)
+		}
+		value = strconv.FormatBool(on)
+	default:
+		return false, fmt.Errorf("don't understand condition %s", cond)
+	}
+
+	return (value == want) != negate, nil
+}
+
+// composite overlays the loaded files in order. If one of them can't be
+// overlaid, the first error is returned along with the composite.
+func (loader *layerLoader) composite() (*SpecLayer, *SpecOrigins, error) {
+	composite := SpecLayer{}
+	origins := SpecOrigins{}
+	var rc error
+	for _, file := range loader.files {
+		origins.apply(&composite, file.layer, newOrigins(file.layer, file.path))
+		err := composite.overlay(file.layer)
+		if err != nil && rc == nil {
+			rc = fmt.Errorf("%s: %w", file.path, err)
+		}
+	}
+	return &composite, &origins, rc
+}
+
+// References to parameters look like ${param.build_type}; $${...} escapes
+// one.
+var paramRegexp = regexp.MustCompile(`\$?\$\{param\.([A-Za-z0-9_]+)\}`)
+
+// substituteParams fills in pkg's parameters everywhere in it, from params
+// and the defaults pkg declares.
+func substituteParams(pkg *Spec, params map[string]string) error {
+	values := map[string]string{}
+	for name, value := range pkg.Params {
+		values[name] = value
+	}
+	for name, value := range params {
+		if _, ok := pkg.Params[name]; !ok {
+			return fmt.Errorf("no parameter %s", name)
+		}
+		values[name] = value
+	}
+
+	var err error
+	expand := func(value string) string {
+		return paramRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+			if ref[1] == '$' {
+				return ref[1:]
+			}
+			name := paramRegexp.FindStringSubmatch(ref)[1]
+			value, ok := values[name]
+			if !ok && err == nil {
+				err = fmt.Errorf("${param.%s}: no such parameter", name)
+			}
+			return value
+		})
+	}
+
+	substituteStrings(reflect.ValueOf(&pkg.Layers).Elem(), expand)
+	substituteStrings(reflect.ValueOf(pkg.Package).Elem(), expand)
+	return err
+}
+
+// substituteStrings runs expand over every string in v, which has to be
+// settable.
+func substituteStrings(v reflect.Value, expand func(string) string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(expand(v.String()))
+	case reflect.Ptr:
+		if !v.IsNil() {
+			substituteStrings(v.Elem(), expand)
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			elem := reflect.New(v.Elem().Type()).Elem()
+			elem.Set(v.Elem())
+			substituteStrings(elem, expand)
+			v.Set(elem)
+		}
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			if v.Type().Field(idx).PkgPath == "" {
+				substituteStrings(v.Field(idx), expand)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for idx := 0; idx < v.Len(); idx++ {
+			substituteStrings(v.Index(idx), expand)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			substituteStrings(elem, expand)
+			v.SetMapIndex(key, elem)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package spec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"m0rg.dev/x10/conf"
+)
+
+// SpecOption is a named switch in a spec. Turning it on overlays its
+// dependencies, environment, sources, patches and stage fragments onto the
+// package, as if they came from one more layer.
+type SpecOption struct {
+	Name        string
+	Description string
+	Default     bool
+	Depends     SpecDepend
+	Environment map[string]string
+	Sources     []SpecSource
+	Patches     []SpecPatch
+	Stages      map[string]*SpecStage
+
+	EnvironmentEntries []SpecEnvironmentEntry `yaml:"-"`
+}
+
+func init() {
+	conf.RegisterKey("", "options", conf.ConfigKey{
+		HelpText: "Comma-separated build options to turn on (name) or off (-name), " +
+			"optionally for one package only (pkg:name).",
+		TakesValue: true,
+		Default:    "",
+	})
+}
+
+func (option SpecOption) layer() SpecLayer {
+	layer := SpecLayer{
+		Depends:     option.Depends,
+		Environment: option.Environment,
+		Sources:     option.Sources,
+		Stages:      option.Stages,
+
+		EnvironmentEntries: option.EnvironmentEntries,
+	}
+	if len(option.Patches) > 0 {
+		layer.Patches = &option.Patches
+	}
+	return layer
+}
+
+// chooseOptions works out which of pkg's options are on: their defaults,
+// then unqualified settings from the options key, then settings for pkg in
+// particular.
+func (pkg SpecLayer) chooseOptions() (map[string]bool, error) {
+	chosen := map[string]bool{}
+	for _, option := range pkg.Options {
+		chosen[option.Name] = option.Default
+	}
+
+	name := ""
+	if pkg.Meta != nil {
+		name = pkg.Meta.Name
+	}
+
+	specific := map[string]bool{}
+	for _, item := range strings.Split(conf.Get("options"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		qualified := false
+		if idx := strings.LastIndex(item, ":"); idx >= 0 {
+			if item[:idx] != name {
+				continue
+			}
+			item = item[idx+1:]
+			qualified = true
+		}
+
+		value := true
+		if strings.HasPrefix(item, "-") {
+			value = false
+			item = strings.TrimPrefix(item, "-")
+		}
+
+		if _, ok := chosen[item]; !ok {
+			if qualified {
+				return nil, fmt.Errorf("%s has no option %s", name, item)
+			}
+			continue
+		}
+
+		if qualified {
+			specific[item] = value
+		} else {
+			chosen[item] = value
+		}
+	}
+
+	for item, value := range specific {
+		chosen[item] = value
+	}
+	return chosen, nil
+}
+
+func (pkg *SpecLayer) applyOptions(origins *SpecOrigins) error {
+	chosen, err := pkg.chooseOptions()
+	if err != nil {
+		return err
+	}
+	pkg.Chosen = chosen
+
+	for _, option := range pkg.Options {
+		if !chosen[option.Name] {
+			continue
+		}
+		layer := option.layer()
+		origin := fmt.Sprintf("%s (option %s)", origins.Options[option.Name], option.Name)
+		origins.apply(pkg, layer, newOrigins(layer, origin))
+		err = pkg.overlay(layer)
+		if err != nil {
+			return fmt.Errorf("option %s: %w", option.Name, err)
+		}
+	}
+	return nil
+}
+
+// EnabledOptions lists the options that are on, by name.
+func (pkg SpecLayer) EnabledOptions() []string {
+	rc := []string{}
+	for name, on := range pkg.Chosen {
+		if on {
+			rc = append(rc, name)
+		}
+	}
+	sort.Strings(rc)
+	return rc
+}
+
+// optionSuffix distinguishes builds with non-default options in the FQN,
+// e.g. foo-1.0_1+docs+no-ssl. It's empty when everything is at its default.
+func (pkg SpecLayer) optionSuffix() string {
+	changed := []string{}
+	for _, option := range pkg.Options {
+		on, ok := pkg.Chosen[option.Name]
+		if !ok || on == option.Default {
+			continue
+		}
+		if on {
+			changed = append(changed, option.Name)
+		} else {
+			changed = append(changed, "no-"+option.Name)
+		}
+	}
+	if len(changed) == 0 {
+		return ""
+	}
+	sort.Strings(changed)
+	return "+" + strings.Join(changed, "+")
+}
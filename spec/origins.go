@@ -0,0 +1,240 @@
+package spec
+
+// SpecOrigins mirrors a composited SpecLayer, holding the path of the file
+// each value (or list entry) came from. Empty strings mean a default.
+type SpecOrigins struct {
+	Meta        string
+	Depends     SpecDepend
+	Sources     []string
+	Stages      map[string]*StageOrigins
+	StageOrder  string
+	Environment map[string]string
+	Workdir     string
+	Patches     []string
+	TriggerData map[string]string
+	Runner      RunnerOrigins
+	Subpackages map[string]string // by name
+	Options     map[string]string // by name
+}
+
+type StageOrigins struct {
+	PreScript  []string
+	Script     string
+	PostScript []string
+	Steps      map[string]string // by name
+	UseWorkdir string
+	Network    string
+	Timeout    string
+	Memory     string
+	CPUs       string
+}
+
+type RunnerOrigins struct {
+	Image   string
+	Mounts  []string
+	Tmpfs   map[string]string // by target
+	PassEnv []string
+}
+
+// newOrigins attributes everything layer sets to path.
+func newOrigins(layer SpecLayer, path string) SpecOrigins {
+	origins := SpecOrigins{
+		Depends: SpecDepend{
+			HostBuild: repeat(path, len(layer.Depends.HostBuild)),
+			Build:     repeat(path, len(layer.Depends.Build)),
+			Test:      repeat(path, len(layer.Depends.Test)),
+			Run:       repeat(path, len(layer.Depends.Run)),
+		},
+		Sources:     repeat(path, len(layer.Sources)),
+		Stages:      map[string]*StageOrigins{},
+		Environment: map[string]string{},
+		TriggerData: map[string]string{},
+		Runner: RunnerOrigins{
+			Mounts:  repeat(path, len(layer.Runner.Mounts)),
+			Tmpfs:   map[string]string{},
+			PassEnv: repeat(path, len(layer.Runner.PassEnv)),
+		},
+		Subpackages: map[string]string{},
+		Options:     map[string]string{},
+	}
+
+	if layer.Meta != nil {
+		origins.Meta = path
+	}
+	if layer.StageOrder != nil {
+		origins.StageOrder = path
+	}
+	if len(layer.Workdir) > 0 {
+		origins.Workdir = path
+	}
+	if layer.Patches != nil {
+		origins.Patches = repeat(path, len(*layer.Patches))
+	}
+	if layer.Runner.Image != nil {
+		origins.Runner.Image = path
+	}
+
+	for name, stage := range layer.Stages {
+		stage_origins := &StageOrigins{
+			PreScript:  repeat(path, len(stage.PreScript)),
+			PostScript: repeat(path, len(stage.PostScript)),
+			Steps:      map[string]string{},
+		}
+		for _, step := range stage.Steps {
+			stage_origins.Steps[step.Name] = path
+		}
+		if stage.Script != nil {
+			stage_origins.Script = path
+		}
+		if stage.UseWorkdir != nil {
+			stage_origins.UseWorkdir = path
+		}
+		if stage.Network != nil {
+			stage_origins.Network = path
+		}
+		if stage.Timeout != nil {
+			stage_origins.Timeout = path
+		}
+		if stage.Memory != nil {
+			stage_origins.Memory = path
+		}
+		if stage.CPUs != nil {
+			stage_origins.CPUs = path
+		}
+		origins.Stages[name] = stage_origins
+	}
+
+	for name := range layer.Environment {
+		origins.Environment[name] = path
+	}
+	for name := range layer.TriggerData {
+		origins.TriggerData[name] = path
+	}
+	for _, tmpfs := range layer.Runner.Tmpfs {
+		origins.Runner.Tmpfs[tmpfs.Target] = path
+	}
+	for _, sub := range layer.Subpackages {
+		origins.Subpackages[sub.Name] = path
+	}
+	for _, option := range layer.Options {
+		origins.Options[option.Name] = path
+	}
+
+	return origins
+}
+
+// apply follows LoadPackage's overlay rules for layer being composited onto
+// composite. It has to be called before composite is updated.
+func (origins *SpecOrigins) apply(composite *SpecLayer, layer SpecLayer, from SpecOrigins) {
+	if layer.Meta != nil {
+		origins.Meta = from.Meta
+	}
+
+	origins.Depends.HostBuild = append(origins.Depends.HostBuild, from.Depends.HostBuild...)
+	origins.Depends.Build = append(origins.Depends.Build, from.Depends.Build...)
+	origins.Depends.Test = append(origins.Depends.Test, from.Depends.Test...)
+	origins.Depends.Run = append(origins.Depends.Run, from.Depends.Run...)
+
+	origins.Sources = append(origins.Sources, from.Sources...)
+
+	if origins.Stages == nil {
+		origins.Stages = map[string]*StageOrigins{}
+	}
+	for name, stage := range layer.Stages {
+		stage_from := from.Stages[name]
+		if stage_from == nil {
+			stage_from = &StageOrigins{}
+		}
+
+		if _, ok := composite.Stages[name]; !ok {
+			origins.Stages[name] = &StageOrigins{}
+		}
+		current := origins.Stages[name]
+
+		current.PreScript = append(current.PreScript, stage_from.PreScript...)
+		current.PostScript = append(append([]string{}, stage_from.PostScript...), current.PostScript...)
+
+		if stage.Script != nil {
+			current.Script = stage_from.Script
+		}
+		if current.Steps == nil {
+			current.Steps = map[string]string{}
+		}
+		for _, step := range stage.Steps {
+			current.Steps[step.Name] = stage_from.Steps[step.Name]
+		}
+		if stage.UseWorkdir != nil {
+			current.UseWorkdir = stage_from.UseWorkdir
+		}
+		if stage.Network != nil {
+			current.Network = stage_from.Network
+		}
+		if stage.Timeout != nil {
+			current.Timeout = stage_from.Timeout
+		}
+		if stage.Memory != nil {
+			current.Memory = stage_from.Memory
+		}
+		if stage.CPUs != nil {
+			current.CPUs = stage_from.CPUs
+		}
+	}
+
+	if layer.StageOrder != nil {
+		origins.StageOrder = from.StageOrder
+	}
+
+	if origins.Environment == nil {
+		origins.Environment = map[string]string{}
+	}
+	for name := range layer.Environment {
+		origins.Environment[name] = from.Environment[name]
+	}
+
+	if len(layer.Workdir) > 0 {
+		origins.Workdir = from.Workdir
+	}
+
+	origins.Patches = append(origins.Patches, from.Patches...)
+
+	if origins.TriggerData == nil {
+		origins.TriggerData = map[string]string{}
+	}
+	for name := range layer.TriggerData {
+		origins.TriggerData[name] = from.TriggerData[name]
+	}
+
+	if layer.Runner.Image != nil {
+		origins.Runner.Image = from.Runner.Image
+	}
+	origins.Runner.Mounts = append(origins.Runner.Mounts, from.Runner.Mounts...)
+	origins.Runner.PassEnv = append(origins.Runner.PassEnv, from.Runner.PassEnv...)
+	if origins.Runner.Tmpfs == nil {
+		origins.Runner.Tmpfs = map[string]string{}
+	}
+	for _, tmpfs := range layer.Runner.Tmpfs {
+		origins.Runner.Tmpfs[tmpfs.Target] = from.Runner.Tmpfs[tmpfs.Target]
+	}
+
+	if origins.Subpackages == nil {
+		origins.Subpackages = map[string]string{}
+	}
+	for _, sub := range layer.Subpackages {
+		origins.Subpackages[sub.Name] = from.Subpackages[sub.Name]
+	}
+
+	if origins.Options == nil {
+		origins.Options = map[string]string{}
+	}
+	for _, option := range layer.Options {
+		origins.Options[option.Name] = from.Options[option.Name]
+	}
+}
+
+func repeat(value string, count int) []string {
+	rc := make([]string, count)
+	for idx := range rc {
+		rc[idx] = value
+	}
+	return rc
+}
@@ -1,14 +1,11 @@
 package spec
 
 import (
-	"errors"
-	"io/ioutil"
+	"fmt"
 	"path/filepath"
 	"strconv"
 
-	"gopkg.in/yaml.v2"
 	"m0rg.dev/x10/conf"
-	"m0rg.dev/x10/x10_log"
 )
 
 type SpecMeta struct {
@@ -22,6 +19,35 @@ type SpecMeta struct {
 	UnpackDir   *string
 }
 
+// merge returns meta with the fields set in over replacing its own.
+func (meta SpecMeta) merge(over SpecMeta) SpecMeta {
+	if over.Name != "" {
+		meta.Name = over.Name
+	}
+	if over.Version != "" {
+		meta.Version = over.Version
+	}
+	if over.Revision != 0 {
+		meta.Revision = over.Revision
+	}
+	if over.Maintainer != "" {
+		meta.Maintainer = over.Maintainer
+	}
+	if over.Homepage != "" {
+		meta.Homepage = over.Homepage
+	}
+	if over.License != "" {
+		meta.License = over.License
+	}
+	if over.Description != "" {
+		meta.Description = over.Description
+	}
+	if over.UnpackDir != nil {
+		meta.UnpackDir = over.UnpackDir
+	}
+	return meta
+}
+
 type SpecDepend struct {
 	HostBuild []string
 	Build     []string
@@ -31,6 +57,12 @@ type SpecDepend struct {
 
 type SpecDbData struct {
 	Meta              SpecMeta
+	Parent            string                 `yaml:",omitempty"` // spec name, for subpackages
+	Options           map[string]bool        `yaml:",omitempty"` // as built
+	Variant           string                 `yaml:",omitempty"` // FQN suffix for non-default options
+	BuildHash         string                 `yaml:",omitempty"` // of BuildInputs, as last built
+	BuildInputs       map[string]string      `yaml:",omitempty"`
+	TriggerData       map[string]interface{} `yaml:",omitempty"` // as built, for removing it later
 	Depends           SpecDepend
 	GeneratedValid    bool
 	GeneratedDepends  []string
@@ -42,11 +74,93 @@ type SpecSource struct {
 	Checksum string
 }
 
+// SpecPatch is a patch from the files directory. In a spec it's either just
+// the file name, or a mapping with a strip level for patch -p (default 1).
+type SpecPatch struct {
+	File  string
+	Strip *int `yaml:",omitempty"`
+}
+
+func (patch *SpecPatch) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var file string
+	if unmarshal(&file) == nil {
+		patch.File = file
+		return nil
+	}
+
+	type plain SpecPatch
+	return unmarshal((*plain)(patch))
+}
+
+func (patch SpecPatch) MarshalYAML() (interface{}, error) {
+	if patch.Strip == nil {
+		return patch.File, nil
+	}
+	type plain SpecPatch
+	return plain(patch), nil
+}
+
+func (patch SpecPatch) StripLevel() int {
+	if patch.Strip == nil {
+		return 1
+	}
+	return *patch.Strip
+}
+
 type SpecStage struct {
 	PreScript  []string
 	Script     *string
 	PostScript []string
+	Steps      []SpecStep
 	UseWorkdir *bool
+	Network    *bool
+	Timeout    *string // e.g. "2h"
+	Memory     *string // e.g. "4g"
+	CPUs       *float64
+}
+
+// SpecStep is one named command in a stage. Steps run after the stage's
+// script, in order, each in its own subshell. A layer can put a step before
+// or after one from a lower layer by name; a step with the same name as an
+// existing one replaces it.
+type SpecStep struct {
+	Name            string
+	Command         string
+	Dir             string            `yaml:",omitempty"` // relative to the stage's directory
+	Environment     map[string]string `yaml:",omitempty"`
+	ContinueOnError bool              `yaml:"continue-on-error,omitempty"`
+	Before          string            `yaml:",omitempty"`
+	After           string            `yaml:",omitempty"`
+}
+
+type SpecMount struct {
+	Source   string // relative to the packages directory
+	Target   string
+	ReadOnly bool
+}
+
+type SpecTmpfs struct {
+	Target string
+	Size   string
+}
+
+type SpecRunner struct {
+	Image   *string
+	Mounts  []SpecMount
+	Tmpfs   []SpecTmpfs
+	PassEnv []string
+}
+
+// SpecSubpackage splits some of a package's files off into a package of their
+// own, built alongside it. Meta is merged over the parent's, except for the
+// name and unpack directory.
+type SpecSubpackage struct {
+	Name        string
+	Description string // shorthand for meta.description
+	Meta        *SpecMeta
+	Depends     []string // run dependencies
+	Files       []string // patterns relative to DESTDIR; ** matches across directories
+	TriggerData map[string]interface{}
 }
 
 type SpecLayer struct {
@@ -57,152 +171,365 @@ type SpecLayer struct {
 	StageOrder  *[]string
 	Environment map[string]string
 	Workdir     string
-	Patches     *[]string
+	Patches     *[]SpecPatch
 	TriggerData map[string]interface{}
+	Runner      SpecRunner
+	Subpackages []SpecSubpackage
+	Options     []SpecOption
+
+	// Set on layers made by Subpackage; never read from a spec.
+	Parent string `yaml:"-"`
+	// Which options are on, set by LoadPackage.
+	Chosen map[string]bool `yaml:"-"`
+	// Every environment assignment, in the order they're exported: each
+	// layer's in declaration order, then the package's.
+	EnvironmentEntries []SpecEnvironmentEntry `yaml:"-"`
+	// Every spec and layer file that went into this one, in load order.
+	Files []string `yaml:"-"`
+}
+
+type SpecEnvironmentEntry struct {
+	Name  string
+	Value string
 }
 
 type Spec struct {
-	Layers  []string
+	Layers  []SpecLayerRef
+	Params  map[string]string // a layer's parameters, with their defaults
 	Package *SpecLayer
 }
 
 func (pkg SpecLayer) GetFQN() string {
-	return pkg.Meta.Name + "-" + pkg.Meta.Version + "_" + strconv.Itoa(pkg.Meta.Revision)
+	return pkg.Meta.Name + "-" + pkg.Meta.Version + "_" + strconv.Itoa(pkg.Meta.Revision) + pkg.optionSuffix()
 }
 
 func (pkg SpecDbData) GetFQN() string {
-	return pkg.Meta.Name + "-" + pkg.Meta.Version + "_" + strconv.Itoa(pkg.Meta.Revision)
+	return pkg.Meta.Name + "-" + pkg.Meta.Version + "_" + strconv.Itoa(pkg.Meta.Revision) + pkg.Variant
 }
 
 func (pkg SpecLayer) ToDB() SpecDbData {
 	return SpecDbData{
-		*pkg.Meta,
-		pkg.Depends,
-		false,
-		[]string{},
-		[]string{},
+		Meta:              *pkg.Meta,
+		Parent:            pkg.Parent,
+		Options:           pkg.Chosen,
+		Variant:           pkg.optionSuffix(),
+		Depends:           pkg.Depends,
+		TriggerData:       pkg.TriggerData,
+		GeneratedValid:    false,
+		GeneratedDepends:  []string{},
+		GeneratedProvides: []string{},
 	}
 }
 
+// SpecName is the name of the spec file pkg is built from.
+func (pkg SpecDbData) SpecName() string {
+	if pkg.Parent != "" {
+		return pkg.Parent
+	}
+	return pkg.Meta.Name
+}
+
 func (pkg SpecDbData) ToLayer() (*SpecLayer, error) {
-	return LoadPackage(filepath.Join(conf.Get("packages"), pkg.Meta.Name+".yml"))
+	layer, err := LoadPackage(filepath.Join(conf.Get("packages"), pkg.SpecName()+".yml"))
+	if err != nil || pkg.Parent == "" {
+		return layer, err
+	}
+	return layer.Subpackage(pkg.Meta.Name)
+}
+
+// Subpackage returns the package for the named subpackage of pkg. It shares
+// pkg's stages, environment and (unless it has its own) meta, so its package
+// stage runs the same way against its own DESTDIR.
+func (pkg SpecLayer) Subpackage(name string) (*SpecLayer, error) {
+	for _, sub := range pkg.Subpackages {
+		if sub.Name != name {
+			continue
+		}
+
+		meta := *pkg.Meta
+		if sub.Description != "" {
+			meta.Description = sub.Description
+		}
+		if sub.Meta != nil {
+			meta = meta.merge(*sub.Meta)
+		}
+		meta.Name = sub.Name
+		unpack_dir := pkg.Meta.Name
+		if pkg.Meta.UnpackDir != nil {
+			unpack_dir = *pkg.Meta.UnpackDir
+		}
+		meta.UnpackDir = &unpack_dir
+
+		rc := pkg
+		rc.Meta = &meta
+		rc.Depends = SpecDepend{Run: sub.Depends}
+		rc.TriggerData = sub.TriggerData
+		rc.Subpackages = nil
+		rc.Parent = pkg.Meta.Name
+		return &rc, nil
+	}
+	return nil, fmt.Errorf("%s has no subpackage %s", pkg.Meta.Name, name)
 }
 
 func LoadPackage(pkgsrc string) (*SpecLayer, error) {
-	pkg := Spec{}
+	composite, _, err := LoadPackageOrigins(pkgsrc)
+	return composite, err
+}
+
+// LoadPackageOrigins is LoadPackage, but also reports which file each part of
+// the composited package came from.
+func LoadPackageOrigins(pkgsrc string) (*SpecLayer, *SpecOrigins, error) {
+	// Layers can be conditional on options, but layers can also declare
+	// options, so the options are worked out from the unconditional layers
+	// first.
+	loader := &layerLoader{}
+	err := loader.load(pkgsrc, nil, []string{pkgsrc})
+	if err != nil {
+		return nil, nil, err
+	}
+	composite, origins, err := loader.composite()
+	if err != nil && !loader.skipped {
+		// (Otherwise, the step might be next to one in a conditional
+		// layer, so try again with them.)
+		return nil, nil, err
+	}
 
-	logger := x10_log.Get("load").WithField("pkgsrc", pkgsrc)
+	if loader.skipped {
+		chosen, err := composite.chooseOptions()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", pkgsrc, err)
+		}
+
+		loader = &layerLoader{chosen: chosen}
+		err = loader.load(pkgsrc, nil, []string{pkgsrc})
+		if err != nil {
+			return nil, nil, err
+		}
+		composite, origins, err = loader.composite()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-	// Load the package YAML
-	logger.Debug("Loading package")
-	pkgraw, err := ioutil.ReadFile(pkgsrc)
+	// Options are only applied once everything's been composited, since
+	// any layer might declare or override them.
+	err = composite.applyOptions(origins)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("%s: %w", pkgsrc, err)
 	}
 
-	err = yaml.UnmarshalStrict(pkgraw, &pkg)
+	err = composite.interpolate()
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("%s: %w", pkgsrc, err)
 	}
 
-	// Load and apply the layers.
-	composite := SpecLayer{}
+	return composite, origins, nil
+}
 
-	layers := make([]SpecLayer, len(pkg.Layers)+1)
-	for idx, layer_name := range pkg.Layers {
-		logger.Debug("Loading layer: ", layer_name)
-		layer, err := LoadPackage(filepath.Join(conf.Get("packages"), "layers", layer_name+".yml"))
-		if err != nil {
-			return nil, err
-		}
-		layers[idx] = *layer
+// overlay applies layer on top of composite, following the rules for each
+// part of a spec.
+func (composite *SpecLayer) overlay(layer SpecLayer) error {
+	// Meta: Take the last complete struct.
+	if layer.Meta != nil {
+		composite.Meta = layer.Meta
 	}
 
-	if pkg.Package == nil {
-		return nil, errors.New("no package object?")
+	// Depends: Concatenate arrays.
+	composite.Depends.HostBuild = append(composite.Depends.HostBuild, layer.Depends.HostBuild...)
+	composite.Depends.Build = append(composite.Depends.Build, layer.Depends.Build...)
+	composite.Depends.Test = append(composite.Depends.Test, layer.Depends.Test...)
+	composite.Depends.Run = append(composite.Depends.Run, layer.Depends.Run...)
+
+	// Sources: Concatenate.
+	composite.Sources = append(composite.Sources, layer.Sources...)
+
+	// Stages: Piece-wise overlay.
+	var step_err error
+	if composite.Stages == nil {
+		composite.Stages = make(map[string]*SpecStage)
 	}
 
-	layers = append(layers, *pkg.Package)
+	for name, stage := range layer.Stages {
+		// Make sure we have an object.
+		if _, ok := composite.Stages[name]; !ok {
+			composite.Stages[name] = new(SpecStage)
+			composite.Stages[name].UseWorkdir = new(bool)
+			*composite.Stages[name].UseWorkdir = false
+		}
 
-	for _, layer := range layers {
-		// Meta: Take the last complete struct.
-		if layer.Meta != nil {
-			composite.Meta = layer.Meta
+		// Append pre- and post- arrays. Note ordering.
+		composite.Stages[name].PreScript = append(composite.Stages[name].PreScript, stage.PreScript...)
+		composite.Stages[name].PostScript = append(stage.PostScript, composite.Stages[name].PostScript...)
+
+		// And take the script directly if present.
+		if stage.Script != nil {
+			composite.Stages[name].Script = stage.Script
 		}
 
-		// Depends: Concatenate arrays.
-		composite.Depends.HostBuild = append(composite.Depends.HostBuild, layer.Depends.HostBuild...)
-		composite.Depends.Build = append(composite.Depends.Build, layer.Depends.Build...)
-		composite.Depends.Test = append(composite.Depends.Test, layer.Depends.Test...)
-		composite.Depends.Run = append(composite.Depends.Run, layer.Depends.Run...)
+		// Steps: Insert where asked, replace by name, or append. A step
+		// that can't be placed still gets appended, so the rest of the
+		// spec can be worked out, but overlay fails.
+		steps, err := overlaySteps(composite.Stages[name].Steps, stage.Steps)
+		if err != nil && step_err == nil {
+			step_err = fmt.Errorf("stage %s: %w", name, err)
+		}
+		composite.Stages[name].Steps = steps
 
-		// Sources: Concatenate.
-		composite.Sources = append(composite.Sources, layer.Sources...)
+		// UseWorkdir: Take last.
+		if stage.UseWorkdir != nil {
+			composite.Stages[name].UseWorkdir = stage.UseWorkdir
+		}
 
-		// Stages: Piece-wise overlay.
-		if composite.Stages == nil {
-			composite.Stages = make(map[string]*SpecStage)
+		// Network: Take last.
+		if stage.Network != nil {
+			composite.Stages[name].Network = stage.Network
 		}
 
-		for name, stage := range layer.Stages {
-			// Make sure we have an object.
-			if _, ok := composite.Stages[name]; !ok {
-				composite.Stages[name] = new(SpecStage)
-				composite.Stages[name].UseWorkdir = new(bool)
-				*composite.Stages[name].UseWorkdir = false
-			}
+		// Limits: Take last.
+		if stage.Timeout != nil {
+			composite.Stages[name].Timeout = stage.Timeout
+		}
+		if stage.Memory != nil {
+			composite.Stages[name].Memory = stage.Memory
+		}
+		if stage.CPUs != nil {
+			composite.Stages[name].CPUs = stage.CPUs
+		}
+	}
 
-			// Append pre- and post- arrays. Note ordering.
-			composite.Stages[name].PreScript = append(composite.Stages[name].PreScript, stage.PreScript...)
-			composite.Stages[name].PostScript = append(stage.PostScript, composite.Stages[name].PostScript...)
+	// StageOrder: Take the last complete array.
+	if layer.StageOrder != nil {
+		composite.StageOrder = layer.StageOrder
+	}
 
-			// And take the script directly if present.
-			if stage.Script != nil {
-				composite.Stages[name].Script = stage.Script
-			}
+	// Environment: Overlay map contents.
+	if composite.Environment == nil {
+		composite.Environment = make(map[string]string)
+	}
 
-			// UseWorkdir: Take last.
-			if stage.UseWorkdir != nil {
-				composite.Stages[name].UseWorkdir = stage.UseWorkdir
-			}
+	for name, value := range layer.Environment {
+		composite.Environment[name] = value
+	}
+	composite.EnvironmentEntries = append(composite.EnvironmentEntries, layer.environmentEntries()...)
+
+	// Files: Concatenate.
+	composite.Files = append(composite.Files, layer.Files...)
+
+	// Workdir: Take last.
+	if len(layer.Workdir) > 0 {
+		composite.Workdir = layer.Workdir
+	}
+
+	// Patches: Concatenate.
+	if layer.Patches != nil {
+		if composite.Patches == nil {
+			composite.Patches = &[]SpecPatch{}
 		}
+		*composite.Patches = append(*composite.Patches, *layer.Patches...)
+	}
+
+	// TriggerData: Overlay map contents.
+	if composite.TriggerData == nil {
+		composite.TriggerData = make(map[string]interface{})
+	}
 
-		// StageOrder: Take the last complete array.
-		if layer.StageOrder != nil {
-			composite.StageOrder = layer.StageOrder
+	for name, value := range layer.TriggerData {
+		composite.TriggerData[name] = value
+	}
+
+	// Subpackages: Overlay by name.
+	for _, sub := range layer.Subpackages {
+		replaced := false
+		for idx := range composite.Subpackages {
+			if composite.Subpackages[idx].Name == sub.Name {
+				composite.Subpackages[idx] = sub
+				replaced = true
+			}
+		}
+		if !replaced {
+			composite.Subpackages = append(composite.Subpackages, sub)
 		}
+	}
 
-		// Environment: Overlay map contents.
-		if composite.Environment == nil {
-			composite.Environment = make(map[string]string)
+	// Options: Overlay by name.
+	for _, option := range layer.Options {
+		replaced := false
+		for idx := range composite.Options {
+			if composite.Options[idx].Name == option.Name {
+				composite.Options[idx] = option
+				replaced = true
+			}
+		}
+		if !replaced {
+			composite.Options = append(composite.Options, option)
 		}
+	}
 
-		for name, value := range layer.Environment {
-			composite.Environment[name] = value
+	// Runner: Image takes last, mounts and environment concatenate,
+	// tmpfs mounts overlay by target.
+	if layer.Runner.Image != nil {
+		composite.Runner.Image = layer.Runner.Image
+	}
+	composite.Runner.Mounts = append(composite.Runner.Mounts, layer.Runner.Mounts...)
+	composite.Runner.PassEnv = append(composite.Runner.PassEnv, layer.Runner.PassEnv...)
+	for _, tmpfs := range layer.Runner.Tmpfs {
+		replaced := false
+		for idx := range composite.Runner.Tmpfs {
+			if composite.Runner.Tmpfs[idx].Target == tmpfs.Target {
+				composite.Runner.Tmpfs[idx] = tmpfs
+				replaced = true
+			}
+		}
+		if !replaced {
+			composite.Runner.Tmpfs = append(composite.Runner.Tmpfs, tmpfs)
 		}
+	}
+	return step_err
+}
 
-		// Workdir: Take last.
-		if len(layer.Workdir) > 0 {
-			composite.Workdir = layer.Workdir
+// overlaySteps puts a layer's steps into the ones it builds on.
+func overlaySteps(base []SpecStep, layer []SpecStep) ([]SpecStep, error) {
+	rc := append([]SpecStep{}, base...)
+	find := func(name string) int {
+		for idx := range rc {
+			if rc[idx].Name == name {
+				return idx
+			}
 		}
+		return -1
+	}
 
-		// Patches: Concatenate.
-		if layer.Patches != nil {
-			if composite.Patches == nil {
-				composite.Patches = &[]string{}
+	for _, step := range layer {
+		if step.Before == "" && step.After == "" {
+			if idx := find(step.Name); idx >= 0 && step.Name != "" {
+				rc[idx] = step
+			} else {
+				rc = append(rc, step)
 			}
-			*composite.Patches = append(*composite.Patches, *layer.Patches...)
+			continue
 		}
 
-		// TriggerData: Overlay map contents.
-		if composite.TriggerData == nil {
-			composite.TriggerData = make(map[string]interface{})
+		if step.Before != "" && step.After != "" {
+			return append(rc, step), fmt.Errorf("step %s: can't go both before and after other steps", step.Name)
 		}
 
-		for name, value := range layer.TriggerData {
-			composite.TriggerData[name] = value
+		// Moving an existing step: take it out first.
+		if idx := find(step.Name); idx >= 0 && step.Name != "" {
+			rc = append(rc[:idx], rc[idx+1:]...)
 		}
-	}
 
-	return &composite, nil
+		target := step.Before
+		if target == "" {
+			target = step.After
+		}
+		idx := find(target)
+		if idx < 0 {
+			return append(rc, step), fmt.Errorf("step %s: no step %s to go next to", step.Name, target)
+		}
+		if step.After != "" {
+			idx++
+		}
+		rc = append(rc[:idx], append([]SpecStep{step}, rc[idx:]...)...)
+	}
+	return rc, nil
 }
@@ -5,21 +5,72 @@ import (
 	"m0rg.dev/x10/runner"
 )
 
+// CommandTrigger runs scripts in the target root. Install is also accepted
+// as script. Without an upgrade script, upgrading runs the old package's
+// remove script and then the new one's install script. The upgrade script
+// gets the old and new FQNs as $X10_OLD_FQN and $X10_NEW_FQN.
 type CommandTrigger struct{}
 type CommandTriggerData struct {
-	Script string
+	Install string
+	Remove  string
+	Upgrade string
 }
 
 func init() {
 	RegisterTrigger(CommandTrigger{}, "command")
 }
 
-func (CommandTrigger) RunInstall(logger *logrus.Entry, root string, raw_data interface{}) error {
+func commandTriggerData(raw_data interface{}) CommandTriggerData {
 	data := CommandTriggerData{}
 	raw_data_map := raw_data.(map[interface{}]interface{})
 	if raw_data_map["script"] != nil {
-		data.Script = raw_data_map["script"].(string)
+		data.Install = raw_data_map["script"].(string)
+	}
+	if raw_data_map["install"] != nil {
+		data.Install = raw_data_map["install"].(string)
+	}
+	if raw_data_map["remove"] != nil {
+		data.Remove = raw_data_map["remove"].(string)
+	}
+	if raw_data_map["upgrade"] != nil {
+		data.Upgrade = raw_data_map["upgrade"].(string)
+	}
+	return data
+}
+
+func runCommand(logger *logrus.Entry, root string, script string) error {
+	if script == "" {
+		return nil
+	}
+
+	opts, err := runner.NewOptions(nil)
+	if err != nil {
+		return err
+	}
+
+	return runner.RunTargetScript(logger, root, script, opts)
+}
+
+func (CommandTrigger) RunInstall(logger *logrus.Entry, root string, raw_data interface{}) error {
+	return runCommand(logger, root, commandTriggerData(raw_data).Install)
+}
+
+func (CommandTrigger) RunRemove(logger *logrus.Entry, root string, raw_data interface{}) error {
+	return runCommand(logger, root, commandTriggerData(raw_data).Remove)
+}
+
+func (t CommandTrigger) RunUpgrade(logger *logrus.Entry, root string, old_fqn string, old_data interface{}, new_fqn string, new_data interface{}) error {
+	data := commandTriggerData(new_data)
+	if data.Upgrade == "" {
+		err := t.RunRemove(logger, root, old_data)
+		if err != nil {
+			return err
+		}
+		return t.RunInstall(logger, root, new_data)
 	}
 
-	return runner.RunTargetScript(logger, root, data.Script, []string{})
+	return runCommand(logger, root,
+		"export X10_OLD_FQN="+runner.ShellQuote(old_fqn)+"\n"+
+			"export X10_NEW_FQN="+runner.ShellQuote(new_fqn)+"\n"+
+			data.Upgrade)
 }
@@ -1,13 +1,20 @@
 package trigger
 
 import (
+	"sort"
+
 	"github.com/sirupsen/logrus"
-	"m0rg.dev/x10/spec"
 	"m0rg.dev/x10/x10_log"
 )
 
 type Trigger interface {
 	RunInstall(logger *logrus.Entry, root string, data interface{}) error
+	// RunRemove undoes RunInstall. It runs before the package's files are
+	// removed.
+	RunRemove(logger *logrus.Entry, root string, data interface{}) error
+	// RunUpgrade runs when the package old_fqn is replaced by new_fqn, in
+	// place of RunInstall and RunRemove.
+	RunUpgrade(logger *logrus.Entry, root string, old_fqn string, old_data interface{}, new_fqn string, new_data interface{}) error
 }
 
 var triggers = map[string]Trigger{}
@@ -16,12 +23,19 @@ func RegisterTrigger(t Trigger, name string) {
 	triggers[name] = t
 }
 
-func RunTriggers(pkg spec.SpecLayer, root string) error {
-	logger := x10_log.Get("trigger").WithField("pkg", pkg.GetFQN())
-	for name, t := range triggers {
-		data, ok := pkg.TriggerData[name]
-		if ok {
-			err := t.RunInstall(logger.WithField("trigger", name), root, data)
+// IsRegistered reports whether there's a trigger called name.
+func IsRegistered(name string) bool {
+	_, ok := triggers[name]
+	return ok
+}
+
+// RunInstallTriggers runs the triggers a package has data for, once it's
+// been installed.
+func RunInstallTriggers(fqn string, data map[string]interface{}, root string) error {
+	logger := x10_log.Get("trigger").WithField("pkg", fqn)
+	for _, name := range triggerNames() {
+		if trigger_data, ok := data[name]; ok {
+			err := triggers[name].RunInstall(logger.WithField("trigger", name), root, trigger_data)
 			// TODO think about error handling in triggers, in general
 			if err != nil {
 				return err
@@ -31,6 +45,58 @@ func RunTriggers(pkg spec.SpecLayer, root string) error {
 	return nil
 }
 
+// RunRemoveTriggers runs the triggers a package has data for, before it's
+// removed.
+func RunRemoveTriggers(fqn string, data map[string]interface{}, root string) error {
+	logger := x10_log.Get("trigger").WithField("pkg", fqn)
+	for _, name := range triggerNames() {
+		if trigger_data, ok := data[name]; ok {
+			err := triggers[name].RunRemove(logger.WithField("trigger", name), root, trigger_data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunUpgradeTriggers runs once new_fqn has been installed over old_fqn. A
+// trigger only one of them has data for is installed or removed instead.
+func RunUpgradeTriggers(old_fqn string, old_data map[string]interface{}, new_fqn string, new_data map[string]interface{}, root string) error {
+	logger := x10_log.Get("trigger").WithField("pkg", new_fqn)
+	for _, name := range triggerNames() {
+		t := triggers[name]
+		trigger_logger := logger.WithField("trigger", name)
+		old_trigger_data, had := old_data[name]
+		new_trigger_data, has := new_data[name]
+
+		var err error
+		switch {
+		case had && has:
+			err = t.RunUpgrade(trigger_logger, root, old_fqn, old_trigger_data, new_fqn, new_trigger_data)
+		case had:
+			err = t.RunRemove(trigger_logger, root, old_trigger_data)
+		case has:
+			err = t.RunInstall(trigger_logger, root, new_trigger_data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// triggerNames lists the registered triggers, so they run in the same order
+// every time.
+func triggerNames() []string {
+	rc := []string{}
+	for name := range triggers {
+		rc = append(rc, name)
+	}
+	sort.Strings(rc)
+	return rc
+}
+
 func iarrayconv(in []interface{}) []string {
 	ret := make([]string, len(in))
 	for i, v := range in {
@@ -15,7 +15,7 @@ func init() {
 	RegisterTrigger(XmlCatalogTrigger{}, "xmlcatalog")
 }
 
-func (XmlCatalogTrigger) RunInstall(logger *logrus.Entry, root string, raw_data interface{}) error {
+func xmlCatalogTriggerData(raw_data interface{}) XmlCatalogTriggerData {
 	data := XmlCatalogTriggerData{}
 	raw_data_map := raw_data.(map[interface{}]interface{})
 	if raw_data_map["sgmlentries"] != nil {
@@ -24,12 +24,22 @@ func (XmlCatalogTrigger) RunInstall(logger *logrus.Entry, root string, raw_data
 	if raw_data_map["xmlentries"] != nil {
 		data.XmlEntries = iarrayconv(raw_data_map["xmlentries"].([]interface{}))
 	}
+	return data
+}
+
+func (XmlCatalogTrigger) RunInstall(logger *logrus.Entry, root string, raw_data interface{}) error {
+	data := xmlCatalogTriggerData(raw_data)
+
+	opts, err := runner.NewOptions(nil)
+	if err != nil {
+		return err
+	}
 
 	if data.SgmlEntries != nil {
 		logger.Info("Registering SGML catalog entries...")
 		for _, entry := range data.SgmlEntries {
 			logger.Info(entry)
-			err := runner.RunTargetScript(logger, root, "/usr/bin/xmlcatmgr -sc /usr/share/sgml/catalog add "+entry, []string{})
+			err := runner.RunTargetScript(logger, root, "/usr/bin/xmlcatmgr -sc /usr/share/sgml/catalog add "+entry, opts)
 			if err != nil {
 				return err
 			}
@@ -40,7 +50,7 @@ func (XmlCatalogTrigger) RunInstall(logger *logrus.Entry, root string, raw_data
 		logger.Info("Registering XML catalog entries...")
 		for _, entry := range data.XmlEntries {
 			logger.Info(entry)
-			err := runner.RunTargetScript(logger, root, "/usr/bin/xmlcatmgr -c /usr/share/xml/catalog add "+entry, []string{})
+			err := runner.RunTargetScript(logger, root, "/usr/bin/xmlcatmgr -c /usr/share/xml/catalog add "+entry, opts)
 			if err != nil {
 				return err
 			}
@@ -49,3 +59,52 @@ func (XmlCatalogTrigger) RunInstall(logger *logrus.Entry, root string, raw_data
 
 	return nil
 }
+
+// removeEntryScript removes an entry in the form given to add (type, orig
+// and, for XML catalogs, replace), which xmlcatmgr identifies by type and
+// orig alone.
+func removeEntryScript(catalog_args string, entry string) string {
+	return "set -- " + entry + "\n/usr/bin/xmlcatmgr " + catalog_args + " remove \"$1\" \"$2\""
+}
+
+func (XmlCatalogTrigger) RunRemove(logger *logrus.Entry, root string, raw_data interface{}) error {
+	data := xmlCatalogTriggerData(raw_data)
+
+	opts, err := runner.NewOptions(nil)
+	if err != nil {
+		return err
+	}
+
+	if data.SgmlEntries != nil {
+		logger.Info("Removing SGML catalog entries...")
+		for _, entry := range data.SgmlEntries {
+			logger.Info(entry)
+			err := runner.RunTargetScript(logger, root, removeEntryScript("-sc /usr/share/sgml/catalog", entry), opts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if data.XmlEntries != nil {
+		logger.Info("Removing XML catalog entries...")
+		for _, entry := range data.XmlEntries {
+			logger.Info(entry)
+			err := runner.RunTargetScript(logger, root, removeEntryScript("-c /usr/share/xml/catalog", entry), opts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RunUpgrade replaces the old package's entries with the new one's.
+func (t XmlCatalogTrigger) RunUpgrade(logger *logrus.Entry, root string, old_fqn string, old_data interface{}, new_fqn string, new_data interface{}) error {
+	err := t.RunRemove(logger, root, old_data)
+	if err != nil {
+		return err
+	}
+	return t.RunInstall(logger, root, new_data)
+}
@@ -0,0 +1,167 @@
+package x10_log
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+)
+
+// The status board is a block of lines kept at the bottom of the terminal,
+// one per running stage, redrawn underneath log output as it scrolls past.
+// It's only drawn when stderr is a terminal.
+type statusBoard struct {
+	lock      sync.Mutex
+	lines     []*Status
+	drawn     int
+	suspended int
+	ticker    sync.Once
+}
+
+var board statusBoard
+
+var stderr_is_terminal = isTerminal(os.Stderr)
+
+func isTerminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func terminalWidth() int {
+	size, err := unix.IoctlGetWinsize(int(os.Stderr.Fd()), unix.TIOCGWINSZ)
+	if err != nil || size.Col == 0 {
+		return 80
+	}
+	return int(size.Col)
+}
+
+// Status is one line on the status board.
+type Status struct {
+	name    string
+	started time.Time
+	last    string
+}
+
+// NewStatus adds a line for name to the status board. Writing to the Status
+// updates the last output shown; call Done to remove it.
+func NewStatus(name string) *Status {
+	status := &Status{name: name, started: time.Now()}
+
+	board.lock.Lock()
+	defer board.lock.Unlock()
+	board.lines = append(board.lines, status)
+	board.redraw()
+
+	board.ticker.Do(func() {
+		go func() {
+			for range time.Tick(500 * time.Millisecond) {
+				board.lock.Lock()
+				board.redraw()
+				board.lock.Unlock()
+			}
+		}()
+	})
+
+	return status
+}
+
+func (status *Status) Write(p []byte) (int, error) {
+	// Build output is full of progress bars and colour codes; keep only what
+	// won't mess up the board.
+	line := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, string(p)))
+
+	board.lock.Lock()
+	defer board.lock.Unlock()
+	if line != "" {
+		status.last = line
+	}
+	return len(p), nil
+}
+
+func (status *Status) Done() {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+
+	for idx, s := range board.lines {
+		if s == status {
+			board.lines = append(board.lines[:idx], board.lines[idx+1:]...)
+			break
+		}
+	}
+	board.redraw()
+}
+
+// SuspendStatus clears the status board and keeps it hidden until the
+// returned function is called, e.g. while something else owns the terminal.
+func SuspendStatus() func() {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+	board.erase()
+	board.suspended++
+
+	return func() {
+		board.lock.Lock()
+		defer board.lock.Unlock()
+		board.suspended--
+		board.redraw()
+	}
+}
+
+// Callers must hold board.lock for erase and redraw.
+
+func (b *statusBoard) erase() {
+	if b.drawn > 0 {
+		fmt.Fprintf(os.Stderr, "\x1b[%dA\x1b[J", b.drawn)
+		b.drawn = 0
+	}
+}
+
+func (b *statusBoard) redraw() {
+	if !stderr_is_terminal {
+		return
+	}
+
+	b.erase()
+	if b.suspended > 0 {
+		return
+	}
+
+	width := terminalWidth()
+	for _, status := range b.lines {
+		line := fmt.Sprintf("  %s  %s", status.name, time.Since(status.started).Round(time.Second))
+		if status.last != "" {
+			line += "  | " + status.last
+		}
+		if runes := []rune(line); len(runes) > width-1 {
+			line = string(runes[:width-1])
+		}
+		fmt.Fprintln(os.Stderr, line)
+		b.drawn++
+	}
+}
+
+// terminalWriter is where loggers send their output, so log lines end up
+// above the status board rather than in the middle of it.
+type terminalWriter struct{}
+
+func (terminalWriter) Write(p []byte) (int, error) {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+
+	drawn := board.drawn
+	board.erase()
+	n, err := os.Stderr.Write(p)
+	if drawn > 0 {
+		board.redraw()
+	}
+	return n, err
+}
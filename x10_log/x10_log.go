@@ -9,7 +9,7 @@ import (
 
 func Get(what string) *logrus.Entry {
 	log := logrus.New()
-	log.SetOutput(os.Stderr)
+	log.SetOutput(terminalWriter{})
 	if _, ok := os.LookupEnv("X10_DEBUG"); ok {
 		log.SetLevel(logrus.DebugLevel)
 	}